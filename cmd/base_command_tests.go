@@ -4,48 +4,32 @@ package cmd
 
 import (
 	"fmt"
-	"strings"
-
-	gpt4client "ephemyral/pkg"
 
 	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 )
 
-func generateTestCommand(directory string, convID uuid.UUID) (string, error) {
-	filesList, err := getFileList(directory)
-	if err != nil {
-		return "", err
-	}
-
-	fullPrompt := TestCommandPrompt + strings.Join(filesList, "\n")
-
-	gpt4client.SetDebug(false)
-	return gpt4client.GetGPT4ResponseWithPrompt(fullPrompt, convID)
-}
-
 var testCmd = &cobra.Command{
-	Use:   "test [directory]",
-	Short: "Deploy AI models to generate and run optimized test commands for the specified directories, enhancing test accuracy and efficiency.",
-	Long:  "The 'test' command generates a testing command based on the structure of the project's files. It then updates the '.ephemyral' configuration file with the new testing command and executes it. Use this command to ensure your project adheres to testing standards and is free from test errors.",
-	Args:  cobra.MinimumNArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
+	Use:           "test [directory]",
+	Short:         "Deploy AI models to generate and run optimized test commands for the specified directories, enhancing test accuracy and efficiency.",
+	Long:          "The 'test' command generates a testing command based on the structure of the project's files. It then updates the '.ephemyral' configuration file with the new testing command and executes it. Use this command to ensure your project adheres to testing standards and is free from test errors.",
+	Args:          cobra.MinimumNArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
 		directory := args[0]
 
 		// Get the retry count from flags, with a default of 3
 		defaultRetryCount, err := cmd.Flags().GetInt("retry")
 		if err != nil {
-			fmt.Println("Error reading retry count:", err)
-			return
+			return err
 		}
 		
 		convID := uuid.New()
 		fmt.Println(convID)
 
-		if err := executeCommandOfType(directory, "test", convID, defaultRetryCount, retryDelay); err != nil {
-			fmt.Println(err)
-			return
-		}
+		return executeCommandOfType(ctx, directory, "test", convID, defaultRetryCount, retryDelay)
 	},
 }
 
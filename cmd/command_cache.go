@@ -0,0 +1,64 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	gpt4client "ephemyral/pkg"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect or clear the on-disk cache of LLM responses.",
+	Long:  "LLM responses are cached on disk, keyed by provider, model, generation parameters and a hash of the prompt, so that repeating a command does not ask the model the same question again. Cached responses expire after 'cache-ttl' (24h by default, 0 keeps them forever). Use --no-cache to bypass the cache and --offline to serve only cached responses.",
+}
+
+var cacheStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Show the number, size and age of cached LLM responses.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		stats, err := gpt4client.GetCacheStats()
+		if err != nil {
+			fmt.Println("Error reading cache:", err)
+			return
+		}
+
+		fmt.Println("Cache directory:", stats.Dir)
+		fmt.Printf("Entries: %d (%d expired)\n", stats.Entries, stats.Expired)
+		fmt.Printf("Size: %d bytes\n", stats.Bytes)
+		if stats.Entries > 0 {
+			fmt.Println("Oldest:", stats.Oldest.Local().Format(time.RFC3339))
+			fmt.Println("Newest:", stats.Newest.Local().Format(time.RFC3339))
+		}
+	},
+}
+
+var cacheClearCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Remove cached LLM responses.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		expiredOnly, err := cmd.Flags().GetBool("expired")
+		if err != nil {
+			fmt.Println("Error reading expired flag:", err)
+			return
+		}
+
+		removed, err := gpt4client.ClearCache(expiredOnly)
+		if err != nil {
+			fmt.Println("Error clearing cache:", err)
+		}
+		fmt.Printf("Removed %d cached responses\n", removed)
+	},
+}
+
+func init() {
+	cacheClearCmd.Flags().Bool("expired", false, "Only remove responses older than the cache TTL")
+	cacheCmd.AddCommand(cacheStatsCmd, cacheClearCmd)
+	rootCmd.AddCommand(cacheCmd)
+}
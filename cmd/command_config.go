@@ -0,0 +1,99 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// migrateEphemyralFile upgrades the .ephemyral file in directory to the
+// current version, keeping comments, and returns the migrations applied and
+// the backup of the previous file. With --dry-run the result is printed
+// instead of written.
+func migrateEphemyralFile(directory string) ([]string, string, error) {
+	path := filepath.Join(directory, ".ephemyral")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	doc, version, err := parseEphemyralDocument(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %v", path, err)
+	}
+	applied, err := migrateEphemyralDocument(doc, version)
+	if err != nil || len(applied) == 0 {
+		return nil, "", err
+	}
+
+	migrated, err := encodeYAML(doc)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := decodeEphemyralFile(migrated, path); err != nil {
+		return nil, "", fmt.Errorf("the migrated file is not valid:\n%v", err)
+	}
+	if viper.GetBool("dry-run") {
+		fmt.Print(string(migrated))
+		return applied, "", nil
+	}
+
+	backup, err := backupEphemyralFile(path, data, version)
+	if err != nil {
+		return nil, "", err
+	}
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	return applied, backup, writeFileAtomic(path, migrated, perm)
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect and maintain the .ephemyral configuration file.",
+	// The file may be invalid or outdated, so it is not loaded up front.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error { return nil },
+}
+
+var configMigrateCmd = &cobra.Command{
+	Use:   "migrate [directory]",
+	Short: "Upgrade the .ephemyral file to the current schema version in place, keeping a backup of the previous file.",
+	Long: `The 'migrate' command applies the migrations from the version of the '.ephemyral' file in the directory, or the
+current one, to the version this ephemyral uses. Comments are kept, and the previous file is saved next to it as
+'.ephemyral.v<version>.bak'. With --dry-run the migrated file is printed instead.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		directory := "."
+		if len(args) > 0 {
+			directory = args[0]
+		}
+
+		applied, backup, err := migrateEphemyralFile(directory)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Printf(".ephemyral is already at version %d\n", currentConfigVersion)
+			return nil
+		}
+		for _, migration := range applied {
+			fmt.Println("Migrated", migration)
+		}
+		if backup != "" {
+			fmt.Println("The previous file is saved as", backup)
+		}
+		return nil
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configMigrateCmd)
+	rootCmd.AddCommand(configCmd)
+}
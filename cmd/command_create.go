@@ -4,7 +4,9 @@
 package cmd
 
 import (
+	"context"
 	gpt4client "ephemyral/pkg"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -29,9 +31,14 @@ var createCmd = &cobra.Command{
 If the file path is a directory, it uses a query to determine the file names and creates new files based on the provided prompt.`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
 		filePath := args[0]
 
-		convID := uuid.New()
+		convID, err := conversationID(cmd)
+		if err != nil {
+			printPanel(err.Error(), "Error", "red")
+			return
+		}
 		printPanel(convID.String(), "Conversation ID", "cyan")
 
 		userPrompt := "Create a new code file with meaningful content."
@@ -64,14 +71,21 @@ If the file path is a directory, it uses a query to determine the file names and
 				return
 			}
 			for _, name := range filesList {
-				generateNewFile(filepath.Join(filePath, name), userPrompt, convID, retryCount, retryDelay, runBuild, runLint, runTest, runDocs)
+				if ctx.Err() != nil {
+					break
+				}
+				generateNewFile(ctx, filepath.Join(filePath, name), userPrompt, convID, retryCount, retryDelay, runBuild, runLint, runTest, runDocs)
 			}
 		} else {
-			generateNewFile(filePath, userPrompt, convID, retryCount, retryDelay, runBuild, runLint, runTest, runDocs)
+			generateNewFile(ctx, filePath, userPrompt, convID, retryCount, retryDelay, runBuild, runLint, runTest, runDocs)
 		}
 
-		if automode {
-			runAutomode(maxIterations)
+		if automode && ctx.Err() == nil {
+			root := filePath
+			if !fileInfo.IsDir() {
+				root = projectRoot(filePath)
+			}
+			runAutomode(ctx, root, userPrompt, convID, maxIterations)
 		}
 	},
 }
@@ -82,18 +96,20 @@ func printPanel(content, title, color string) {
 	fmt.Printf("[%s] %s: %s\n", title, panel.String(), content)
 }
 
-func runAutomode(iterations int) {
-	for i := 0; i < iterations; i++ {
-		fmt.Println("Automode iteration:", i+1)
-		// Perform actions for each iteration
-		time.Sleep(1 * time.Second) // Placeholder for actual work
+// projectRoot returns the directory holding the .ephemyral file above
+// filePath, or the directory of filePath when there is none.
+func projectRoot(filePath string) string {
+	if directory, err := findEphemyralDirectory(filePath); err == nil {
+		return directory
 	}
-	printPanel("Automode completed.", "Automode", "green")
+	return filepath.Dir(filePath)
 }
 
-func generateNewFile(filePath string, userPrompt string, convID uuid.UUID, retryCount int, retryDelay time.Duration, runBuild, runLint, runTest, runDocs bool) {
+func generateNewFile(ctx context.Context, filePath string, userPrompt string, convID uuid.UUID, retryCount int, retryDelay time.Duration, runBuild, runLint, runTest, runDocs bool) {
 	existingContent := ""
+	fileExisted := false
 	if _, err := os.Stat(filePath); err == nil {
+		fileExisted = true
 		content, err := os.ReadFile(filePath)
 		if err != nil {
 			printPanel(fmt.Sprintf("Error reading existing file content: %s", err), "Error", "red")
@@ -104,8 +120,8 @@ func generateNewFile(filePath string, userPrompt string, convID uuid.UUID, retry
 
 	fullPrompt := fmt.Sprintf("Create a new code file based on this prompt: %s.", userPrompt)
 
-	retryErr := retryWithDelay(retryCount, retryDelay, func() error {
-		newFileContent, err := gpt4client.GetGPT4ResponseWithPrompt(fullPrompt, convID)
+	retryErr := retryWithDelay(ctx, retryCount, retryDelay, func() error {
+		newFileContent, err := gpt4client.GetResponse(ctx, "create", fullPrompt, convID)
 		if err != nil {
 			return fmt.Errorf("error generating new file content: %w", err)
 		}
@@ -126,37 +142,54 @@ func generateNewFile(filePath string, userPrompt string, convID uuid.UUID, retry
 			}
 			printPanel(fmt.Sprintf("Changes applied:\n%s", diff), "Diff", "green")
 		} else {
-			if err := os.WriteFile(filePath, []byte(filteredContent), 0644); err != nil {
+			if err := writeFileAtomic(filePath, []byte(filteredContent), 0644); err != nil {
 				return fmt.Errorf("error writing new file: %w", err)
 			}
 			printPanel("New file created successfully: "+filePath, "Success", "green")
 		}
 
-		if (runBuild && !runCommand("build", filePath, convID, retryCount, retryDelay)) ||
-			(runLint && !runCommand("lint", filePath, convID, retryCount, retryDelay)) ||
-			(runTest && !runCommand("test", filePath, convID, retryCount, retryDelay)) ||
-			(runDocs && !runCommand("docs", filePath, convID, retryCount, retryDelay)) {
+		if failed := runRequestedCommands(ctx, filePath, convID, retryCount, retryDelay, runBuild, runLint, runTest, runDocs); failed != "" {
 			os.Remove(filePath)
+			gpt4client.RecordFeedback(convID, fmt.Sprintf("The generated content for %s failed the %s command, so the file was removed. Take a different approach.", filePath, failed))
 			return fmt.Errorf("command execution failed, file creation was unsuccessful")
 		}
 
 		return nil
 	})
 
-	if retryErr != nil {
+	if retryErr != nil && ctx.Err() != nil {
+		restoreCreatedFile(filePath, existingContent, fileExisted)
+		printPanel("Interrupted. File creation was cancelled.", "Error", "red")
+	} else if errors.Is(retryErr, gpt4client.ErrPromptShown) {
+		return
+	} else if retryErr != nil {
 		printPanel("All retries failed. File creation was unsuccessful.", "Error", "red")
 	}
 }
 
-func retryWithDelay(attempts int, delay time.Duration, function func() error) error {
+// restoreCreatedFile puts back the content a file had before generation, or
+// removes it when it did not exist.
+func restoreCreatedFile(filePath, existingContent string, fileExisted bool) {
+	if !fileExisted {
+		os.Remove(filePath)
+		return
+	}
+	if err := writeFileAtomic(filePath, []byte(existingContent), 0644); err != nil {
+		printPanel(fmt.Sprintf("Error restoring original file content: %s", err), "Error", "red")
+	}
+}
+
+func retryWithDelay(ctx context.Context, attempts int, delay time.Duration, function func() error) error {
 	var err error
 	for i := 0; i <= attempts; i++ {
 		if i > 0 {
 			printPanel(fmt.Sprintf("Retrying... Attempt %d", i), "Retry", "yellow")
-			time.Sleep(delay)
+			if sleepErr := sleepContext(ctx, delay); sleepErr != nil {
+				return sleepErr
+			}
 		}
-		if err = function(); err == nil {
-			return nil
+		if err = function(); err == nil || isFatalLLMError(err) {
+			return err
 		}
 	}
 	return err
@@ -167,7 +200,7 @@ func generateAndApplyDiff(originalContent, newContent, path string) (string, err
 	diffs := dmp.DiffMain(originalContent, newContent, false)
 	unifiedDiff := dmp.DiffPrettyText(diffs)
 
-	if err := os.WriteFile(path, []byte(newContent), 0644); err != nil {
+	if err := writeFileAtomic(path, []byte(newContent), 0644); err != nil {
 		return "", err
 	}
 
@@ -182,5 +215,6 @@ func init() {
 	createCmd.Flags().Bool("docs", false, "Run docs command after creating files")
 	createCmd.Flags().BoolVar(&automode, "automode", false, "Run in automode")
 	createCmd.Flags().IntVar(&maxIterations, "max-iterations", 25, "Maximum iterations for automode")
+	createCmd.Flags().String("resume", "", "Continue the conversation with the given ID")
 	rootCmd.AddCommand(createCmd)
 }
@@ -7,11 +7,11 @@ import (
 	"encoding/base64"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/sha3"
-	"gopkg.in/yaml.v2"
 )
 
 func init() {
@@ -64,6 +64,7 @@ func createEphemyralFile(filename string) {
 
 	// Use the EphemyralFile struct to create the default content
 	content := EphemyralFile{
+		Version:      currentConfigVersion,
 		OpenAIAPIKey: apiKey,
 		BuildCommand: "",
 		TestCommand:  "",
@@ -71,15 +72,8 @@ func createEphemyralFile(filename string) {
 		DocsCommand:  "",
 	}
 
-	// Marshal the content into YAML format
-	data, err := yaml.Marshal(&content)
-	if err != nil {
-		fmt.Printf("Error creating YAML content: %v\n", err)
-		return
-	}
-
 	// Write the YAML data to the .ephemyral file
-	if err = os.WriteFile(filename, data, 0644); err != nil {
+	if err := writeEphemyralFile(filepath.Dir(filename), content); err != nil {
 		fmt.Printf("Error writing .ephemyral file: %v\n", err)
 		return
 	}
@@ -87,18 +81,12 @@ func createEphemyralFile(filename string) {
 }
 
 func checkAndDecryptAPIKey(filename string) {
-	data, err := os.ReadFile(filename)
+	content, err := readEphemyralFile(filepath.Dir(filename))
 	if err != nil {
 		fmt.Printf("Error reading .ephemyral file: %v\n", err)
 		return
 	}
 
-	var content EphemyralFile
-	if err := yaml.Unmarshal(data, &content); err != nil {
-		fmt.Printf("Error parsing .ephemyral file: %v\n", err)
-		return
-	}
-
 	apiKey := content.OpenAIAPIKey
 	reader := bufio.NewReader(os.Stdin)
 
@@ -0,0 +1,228 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+// Statuses of a pipeline step.
+const (
+	StepOK      = "ok"
+	StepFailed  = "failed"
+	StepSkipped = "skipped"
+	StepDryRun  = "dry-run"
+)
+
+// pipelineStep is a command of the pipeline and its outcome.
+type pipelineStep struct {
+	Name      string
+	DependsOn []string
+	Status    string
+	Duration  time.Duration
+	Err       error
+	done      chan struct{}
+}
+
+// pipelineSteps returns a step for every command configured in ephemyral and
+// for the commands they depend on: the built-in types first, then the
+// commands map in name order.
+func pipelineSteps(ephemyral EphemyralFile) ([]*pipelineStep, error) {
+	var names []string
+	for _, name := range []string{"lint", "build", "test", "docs"} {
+		if ephemyral.command(name) != "" {
+			names = append(names, name)
+		}
+	}
+	var entries []string
+	for name := range ephemyral.Commands {
+		entries = append(entries, name)
+	}
+	sort.Strings(entries)
+	for _, name := range entries {
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	steps := map[string]*pipelineStep{}
+	var ordered []*pipelineStep
+	for len(names) > 0 {
+		name := names[0]
+		names = names[1:]
+		if steps[name] != nil {
+			continue
+		}
+		if err := validateCommandName(name); err != nil {
+			return nil, err
+		}
+		step := &pipelineStep{Name: name, DependsOn: ephemyral.Commands[name].DependsOn, done: make(chan struct{})}
+		steps[name] = step
+		ordered = append(ordered, step)
+		names = append(names, step.DependsOn...)
+	}
+	if len(ordered) == 0 {
+		return nil, errors.New("no commands are configured in .ephemyral")
+	}
+	return ordered, checkPipelineCycles(steps)
+}
+
+// checkPipelineCycles returns an error naming a dependency cycle, if any.
+func checkPipelineCycles(steps map[string]*pipelineStep) error {
+	const visiting, visited = 1, 2
+	state := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, dependency := range steps[name].DependsOn {
+			if err := visit(dependency, append(path[:len(path):len(path)], name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+
+	names := make([]string, 0, len(steps))
+	for name := range steps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPipeline runs every step once its dependencies succeeded, steps without
+// a dependency between them in parallel. A step whose dependency did not
+// succeed is skipped.
+func runPipeline(ctx context.Context, directory string, steps []*pipelineStep, convID uuid.UUID, retryCount int, retryDelay time.Duration) {
+	byName := map[string]*pipelineStep{}
+	for _, step := range steps {
+		byName[step.Name] = step
+	}
+
+	var wg sync.WaitGroup
+	for _, step := range steps {
+		wg.Add(1)
+		go func(step *pipelineStep) {
+			defer wg.Done()
+			defer close(step.done)
+			for _, name := range step.DependsOn {
+				dependency := byName[name]
+				<-dependency.done
+				if dependency.Status != StepOK && dependency.Status != StepDryRun {
+					step.Status, step.Err = StepSkipped, fmt.Errorf("%s did not succeed", name)
+					return
+				}
+			}
+
+			start := time.Now()
+			// The dependencies were run above, so the step runs alone, like
+			// ephemyral run does once they succeeded.
+			step.Err = executeStoredCommand(ctx, directory, step.Name, convID, retryCount, retryDelay)
+			step.Duration = time.Since(start)
+			switch {
+			case step.Err == nil:
+				step.Status = StepOK
+			case errors.Is(step.Err, errDryRun):
+				step.Status, step.Err = StepDryRun, nil
+			default:
+				step.Status = StepFailed
+			}
+		}(step)
+	}
+	wg.Wait()
+}
+
+// printPipelineSummary writes a table of the steps and their outcome.
+func printPipelineSummary(out io.Writer, steps []*pipelineStep) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tSTATUS\tDURATION\tDEPENDS ON\tERROR")
+	for _, step := range steps {
+		dependsOn, message := strings.Join(step.DependsOn, ","), ""
+		if dependsOn == "" {
+			dependsOn = "-"
+		}
+		if step.Err != nil {
+			message = step.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", step.Name, step.Status, step.Duration.Round(time.Millisecond), dependsOn, message)
+	}
+	w.Flush()
+}
+
+var pipelineCmd = &cobra.Command{
+	Use:     "pipeline [directory]",
+	Aliases: []string{"ci"},
+	Short:   "Run all configured commands as a dependency graph, in parallel where possible, and summarize the results.",
+	Long: `The 'pipeline' command runs the build, lint, test and docs commands and the commands map of the '.ephemyral'
+file in one conversation. Commands wait for those listed in their depends-on setting, independent ones run in parallel,
+and a command whose dependency failed is skipped. A summary table is printed at the end, and the exit status is
+non-zero when any step did not succeed. The directory defaults to the current one.`,
+	Args:          cobra.MaximumNArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		directory := "."
+		if len(args) > 0 {
+			directory = args[0]
+		}
+		retryCount, err := cmd.Flags().GetInt("retry")
+		if err != nil {
+			return err
+		}
+
+		ephemyral, err := readEphemyralFile(directory)
+		if err != nil {
+			return err
+		}
+		steps, err := pipelineSteps(ephemyral)
+		if err != nil {
+			return err
+		}
+
+		convID := uuid.New()
+		fmt.Println(convID)
+		runPipeline(cmd.Context(), directory, steps, convID, retryCount, retryDelay)
+		printPipelineSummary(os.Stdout, steps)
+
+		failed := 0
+		for _, step := range steps {
+			if step.Status == StepFailed || step.Status == StepSkipped {
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("pipeline failed: %d of %d steps did not succeed", failed, len(steps))
+		}
+		return nil
+	},
+}
+
+func init() {
+	pipelineCmd.Flags().Int("retry", 3, "Number of retries for generating and executing each command")
+	rootCmd.AddCommand(pipelineCmd)
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"ephemyral/pkg/llmtest"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelineRunsDependencyGraph(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Reply("NONE"))
+	defer server.Close()
+	configureTestLLM(t, server)
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte(`build-command: touch built
+commands:
+  test:
+    command: test -f built
+    depends-on: [build]
+  lint:
+    command: exit 1
+    retry: 1
+  docs:
+    command: "true"
+    depends-on: [lint]
+  settings:
+    command: test "$MODE" = ci && test -f here
+    working-dir: sub
+    env:
+      MODE: ci
+    retry: 1
+  first:
+    command: echo go > barrier
+    timeout: 5s
+    retry: 1
+  second:
+    command: read -r line < barrier && test "$line" = go
+    timeout: 5s
+    retry: 1
+`), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "here"), nil, 0644))
+	// Opening the fifo blocks until the other end is opened too, so first and
+	// second only succeed when they run at the same time.
+	if err := exec.Command("mkfifo", filepath.Join(dir, "barrier")).Run(); err != nil {
+		t.Skipf("mkfifo is not available: %v", err)
+	}
+
+	ephemyral, err := readEphemyralFile(dir)
+	require.NoError(t, err)
+	steps, err := pipelineSteps(ephemyral)
+	require.NoError(t, err)
+	runPipeline(context.Background(), dir, steps, uuid.New(), 3, 0)
+
+	statuses := map[string]string{}
+	for _, step := range steps {
+		statuses[step.Name] = step.Status
+	}
+	require.Equal(t, map[string]string{"build": StepOK, "test": StepOK, "lint": StepFailed, "docs": StepSkipped, "settings": StepOK, "first": StepOK, "second": StepOK}, statuses)
+
+	var summary bytes.Buffer
+	printPipelineSummary(&summary, steps)
+	require.Contains(t, summary.String(), "STEP")
+	require.Contains(t, summary.String(), "lint did not succeed")
+}
+
+func TestPipelineRejectsCycles(t *testing.T) {
+	_, err := pipelineSteps(EphemyralFile{Commands: map[string]CommandSettings{
+		"build": {Command: "true", DependsOn: []string{"test"}},
+		"test":  {Command: "true", DependsOn: []string{"build"}},
+	}})
+	require.ErrorContains(t, err, "dependency cycle: build -> test -> build")
+}
@@ -4,6 +4,7 @@
 package cmd
 
 import (
+	"context"
 	gpt4client "ephemyral/pkg"
 	"fmt"
 	"io/fs"
@@ -16,68 +17,163 @@ import (
 	"github.com/spf13/cobra"
 )
 
-func executeRefactorWithRetries(filePath, userPrompt, newFilePath string, convID uuid.UUID, retryCount int, retryDelay time.Duration, runBuild, runLint, runTest, runDocs bool) {
+func executeRefactorWithRetries(ctx context.Context, filePath, userPrompt, newFilePath string, convID uuid.UUID, retryCount int, retryDelay time.Duration, runBuild, runLint, runTest, runDocs bool) {
 	fileContent, err := os.ReadFile(filePath)
 	if err != nil {
 		fmt.Println("Error reading file:", err)
 		return
 	}
+	mode, err := workspaceMode()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	if !(runBuild || runLint || runTest || runDocs) {
+		mode = WorkspaceInPlace
+	}
 
-	restoreContent := func() {
-		err := os.WriteFile(filePath, fileContent, 0644)
+	restoreContent := func(reason string) {
+		err := writeFileAtomic(filePath, fileContent, 0644)
 		if err != nil {
 			fmt.Println("Error restoring the original file content:", err)
 		} else {
-			fmt.Println("All retries failed, original content restored.")
+			fmt.Println(reason + ", original content restored.")
 		}
 	}
 
+	// Never leave a modified file behind when the run is interrupted.
+	completed := false
+	defer func() {
+		if !completed && ctx.Err() != nil {
+			restoreContent("Interrupted")
+		}
+	}()
+
 	for retry := 0; retry <= retryCount; retry++ {
 		if retry > 0 {
 			fmt.Println("Retrying refactor... Attempt", retry)
-			time.Sleep(retryDelay)
+			if err := sleepContext(ctx, retryDelay); err != nil {
+				return
+			}
 		}
 
-		if refactorFile(filePath, string(fileContent), userPrompt, newFilePath, convID) {
-			if (runBuild && !runCommand("build", filePath, convID, retryCount, retryDelay)) ||
-				(runLint && !runCommand("lint", filePath, convID, retryCount, retryDelay)) ||
-				(runTest && !runCommand("test", filePath, convID, retryCount, retryDelay)) ||
-				(runDocs && !runCommand("docs", filePath, convID, retryCount, retryDelay)) {
-				restoreContent()
+		targetFilePath, refactored, err := refactorFile(ctx, filePath, string(fileContent), userPrompt, newFilePath, convID)
+		if err == nil {
+			var failed string
+			failed, err = applyRefactor(ctx, mode, filePath, targetFilePath, refactored, func(path string) string {
+				return runRequestedCommands(ctx, path, convID, retryCount, retryDelay, runBuild, runLint, runTest, runDocs)
+			})
+			if err == nil && failed != "" {
+				if ctx.Err() != nil {
+					return
+				}
+				if mode == WorkspaceInPlace {
+					restoreContent("All retries failed")
+					gpt4client.RecordFeedback(convID, fmt.Sprintf("The refactored version of %s failed the %s command, so the original content was restored. Take a different approach.", filePath, failed))
+				} else {
+					fmt.Println("The refactored file failed in the workspace and was discarded.")
+					gpt4client.RecordFeedback(convID, fmt.Sprintf("The refactored version of %s failed the %s command, so it was discarded. Take a different approach.", filePath, failed))
+				}
 				continue
 			}
+			if err == nil {
+				completed = true
+				return
+			}
+		}
+		fmt.Println(err)
+		if ctx.Err() != nil || isFatalLLMError(err) {
 			return
 		}
 	}
-	restoreContent()
+	if mode == WorkspaceInPlace {
+		restoreContent("All retries failed")
+	} else {
+		fmt.Println("All retries failed, the project is unchanged.")
+	}
 }
 
-func refactorFile(filePath, fileContent, userPrompt, newFilePath string, convID uuid.UUID) bool {
-	fullPrompt := fmt.Sprintf(RefactorPromptPattern, userPrompt, fileContent)
-	gpt4client.SetDebug(false)
-	refactoredContent, err := gpt4client.GetGPT4ResponseWithPrompt(fullPrompt, convID)
+// applyRefactor writes the refactored content to targetFilePath and runs
+// verify, which returns the failed command type, if any. In the copy and
+// worktree modes both happen in a scratch copy of the project holding
+// filePath, and the file reaches the project only when verify succeeds. A
+// target outside the project is written directly once verify succeeds.
+func applyRefactor(ctx context.Context, mode, filePath, targetFilePath string, content []byte, verify func(path string) string) (string, error) {
+	if mode == WorkspaceInPlace {
+		if err := writeFileAtomic(targetFilePath, content, 0644); err != nil {
+			return "", fmt.Errorf("error writing file: %w", err)
+		}
+		fmt.Println("File refactored successfully:", targetFilePath)
+		return verify(filePath), nil
+	}
+
+	w, err := newWorkspace(ctx, mode, projectRoot(filePath))
 	if err != nil {
-		fmt.Println("Error from LLM:", err)
-		return false
+		return "", err
+	}
+	defer w.remove()
+
+	scratchPath, err := w.path(filePath)
+	_, outsideErr := w.path(targetFilePath)
+	if err == nil && outsideErr == nil {
+		err = w.write(targetFilePath, content)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error writing file: %w", err)
+	}
+	fmt.Println("Verifying the refactored file in", w.dir)
+	if failed := verify(scratchPath); failed != "" {
+		return failed, nil
 	}
+	if err := w.commit(); err != nil {
+		return "", fmt.Errorf("error copying the verified file: %w", err)
+	}
+	if outsideErr != nil {
+		if err := writeFileAtomic(targetFilePath, content, 0644); err != nil {
+			return "", fmt.Errorf("error writing file: %w", err)
+		}
+	}
+	fmt.Println("File refactored successfully:", targetFilePath)
+	return "", nil
+}
+
+// refactorFile returns the path the refactored file belongs at and its
+// content.
+func refactorFile(ctx context.Context, filePath, fileContent, userPrompt, newFilePath string, convID uuid.UUID) (string, []byte, error) {
+	promptBudget, outputBudget := gpt4client.Budget("refactor")
+	parts := splitByTokens("refactor", fileContent, min(promptBudget/2, outputBudget))
+	if len(parts) > 1 {
+		fmt.Printf("%s is too large for a single request, refactoring it in %d parts\n", filePath, len(parts))
+	}
+
+	gpt4client.SetDebug(false)
+	var filteredContent strings.Builder
+	for i, part := range parts {
+		fullPrompt := fmt.Sprintf(RefactorPromptPattern, userPrompt, part)
+		if len(parts) > 1 {
+			fullPrompt = fmt.Sprintf(RefactorChunkPromptPattern, len(parts), i+1, userPrompt, part)
+		}
+
+		refactoredContent, err := gpt4client.GetResponse(ctx, "refactor", fullPrompt, convID)
+		if err != nil {
+			return "", nil, fmt.Errorf("error from LLM: %w", err)
+		}
 
-	filteredContent := filterOutCodeBlocks(refactoredContent)
-	if strings.TrimSpace(filteredContent) == "" {
-		fmt.Println("Insufficient content from LLM after filtering.")
-		return false
+		filteredPart := filterOutCodeBlocks(refactoredContent)
+		if strings.TrimSpace(filteredPart) == "" {
+			return "", nil, fmt.Errorf("insufficient content from LLM after filtering")
+		}
+		filteredContent.WriteString(filteredPart)
+		if i < len(parts)-1 && !strings.HasSuffix(filteredPart, "\n") {
+			filteredContent.WriteString("\n")
+		}
 	}
 
 	targetFilePath := filePath
 	if newFilePath != "" {
 		targetFilePath = filepath.Join(newFilePath, filepath.Base(filePath))
 	}
-
-	if err := os.WriteFile(targetFilePath, []byte(filteredContent), 0644); err != nil {
-		fmt.Println("Error writing file:", err)
-		return false
-	}
-	fmt.Println("File refactored successfully:", targetFilePath)
-	return true
+	return targetFilePath, []byte(filteredContent.String()), nil
 }
 
 var refactorCmd = &cobra.Command{
@@ -87,6 +183,7 @@ var refactorCmd = &cobra.Command{
 and applying the suggested changes, replacing the file content or creating new files in the specified directory.`,
 	Args: cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		ctx := cmd.Context()
 		filePath, userPrompt, newFilePath := args[0], DefaultRefactorPrompt, ""
 		if len(args) > 1 && strings.TrimSpace(args[1]) != "" {
 			userPrompt = args[1]
@@ -95,7 +192,11 @@ and applying the suggested changes, replacing the file content or creating new f
 			newFilePath = args[2]
 		}
 
-		convID := uuid.New()
+		convID, err := conversationID(cmd)
+		if err != nil {
+			fmt.Println("Error:", err)
+			return
+		}
 		fmt.Println(convID)
 
 		retryCount, err := cmd.Flags().GetInt("retry")
@@ -117,11 +218,14 @@ and applying the suggested changes, replacing the file content or creating new f
 				if err != nil || info.IsDir() {
 					return err
 				}
-				executeRefactorWithRetries(path, userPrompt, newFilePath, convID, retryCount, retryDelay, runBuild, runLint, runTest, runDocs)
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				executeRefactorWithRetries(ctx, path, userPrompt, newFilePath, convID, retryCount, retryDelay, runBuild, runLint, runTest, runDocs)
 				return nil
 			})
 		} else {
-			executeRefactorWithRetries(filePath, userPrompt, newFilePath, convID, retryCount, retryDelay, runBuild, runLint, runTest, runDocs)
+			executeRefactorWithRetries(ctx, filePath, userPrompt, newFilePath, convID, retryCount, retryDelay, runBuild, runLint, runTest, runDocs)
 		}
 	},
 }
@@ -132,5 +236,6 @@ func init() {
 	refactorCmd.Flags().Bool("lint", false, "Run lint command after refactoring")
 	refactorCmd.Flags().Bool("test", false, "Run test command after refactoring")
 	refactorCmd.Flags().Bool("docs", false, "Run docs command after refactoring")
+	refactorCmd.Flags().String("resume", "", "Continue the conversation with the given ID")
 	rootCmd.AddCommand(refactorCmd)
 }
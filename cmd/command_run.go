@@ -0,0 +1,45 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+)
+
+var runCmd = &cobra.Command{
+	Use:   "run [name] [directory]",
+	Short: "Run a named command from the .ephemyral file, generating and storing it first when it is missing.",
+	Long: `The 'run' command executes the command called name, such as bench, typecheck or e2e, from the commands
+map of the '.ephemyral' file, or one of the build, test, lint and docs commands. When it is not defined yet, a command
+is generated from the prompt of its entry, or from its name, and stored once it succeeds. The directory defaults to
+the current one.`,
+	Args:          cobra.RangeArgs(1, 2),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		name, directory := args[0], "."
+		if len(args) > 1 {
+			directory = args[1]
+		}
+
+		retryCount, err := cmd.Flags().GetInt("retry")
+		if err != nil {
+			return err
+		}
+
+		convID := uuid.New()
+		fmt.Println(convID)
+
+		return executeCommandOfType(ctx, directory, name, convID, retryCount, retryDelay)
+	},
+}
+
+func init() {
+	runCmd.Flags().Int("retry", 3, "Number of retries for generating and executing the command")
+	rootCmd.AddCommand(runCmd)
+}
@@ -0,0 +1,123 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	gpt4client "ephemyral/pkg"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// usageTotal sums the usage records of one group.
+type usageTotal struct {
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64
+	Estimated        bool
+}
+
+func (t *usageTotal) add(r gpt4client.UsageRecord) {
+	t.Requests++
+	t.PromptTokens += r.PromptTokens
+	t.CompletionTokens += r.CompletionTokens
+	t.Cost += r.Cost
+	t.Estimated = t.Estimated || r.Estimated
+}
+
+// summarizeUsage groups records by the key returned for each of them.
+func summarizeUsage(records []gpt4client.UsageRecord, key func(gpt4client.UsageRecord) string) map[string]*usageTotal {
+	totals := map[string]*usageTotal{}
+	for _, r := range records {
+		k := key(r)
+		if totals[k] == nil {
+			totals[k] = &usageTotal{}
+		}
+		totals[k].add(r)
+	}
+	return totals
+}
+
+// printUsageTable prints one summary table sorted by key.
+func printUsageTable(title string, totals map[string]*usageTotal) {
+	keys := make([]string, 0, len(totals))
+	for k := range totals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Printf("\nBy %s:\n", title)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\tREQUESTS\tPROMPT TOKENS\tCOMPLETION TOKENS\tCOST (USD)\n", title)
+	for _, k := range keys {
+		t := totals[k]
+		cost := fmt.Sprintf("%.4f", t.Cost)
+		if t.Estimated {
+			cost += " (est.)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", k, t.Requests, t.PromptTokens, t.CompletionTokens, cost)
+	}
+	w.Flush()
+}
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Summarize recorded LLM token usage and estimated cost by day, command and model.",
+	Long:  "The 'usage' command reads the ledger of every LLM request made by ephemyral and prints the number of requests, the prompt and completion tokens and the estimated cost, grouped by day, by command and by model. Costs are estimated from the built-in price table, which can be overridden with the 'prices' key of the configuration. Totals marked '(est.)' include requests whose token counts were not reported by the provider and were counted locally.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		days, err := cmd.Flags().GetInt("days")
+		if err != nil {
+			fmt.Println("Error reading days:", err)
+			return
+		}
+
+		records, err := gpt4client.LoadUsage()
+		if err != nil {
+			fmt.Println("Error reading usage ledger:", err)
+			return
+		}
+		if days > 0 {
+			since := time.Now().AddDate(0, 0, -days)
+			filtered := records[:0]
+			for _, r := range records {
+				if r.Time.After(since) {
+					filtered = append(filtered, r)
+				}
+			}
+			records = filtered
+		}
+		if len(records) == 0 {
+			fmt.Println("No usage recorded.")
+			return
+		}
+
+		total := usageTotal{}
+		for _, r := range records {
+			total.add(r)
+		}
+		fmt.Printf("%d requests, %d prompt tokens, %d completion tokens, $%.4f estimated\n",
+			total.Requests, total.PromptTokens, total.CompletionTokens, total.Cost)
+
+		printUsageTable("DAY", summarizeUsage(records, func(r gpt4client.UsageRecord) string {
+			return r.Time.Local().Format("2006-01-02")
+		}))
+		printUsageTable("COMMAND", summarizeUsage(records, func(r gpt4client.UsageRecord) string {
+			return r.Command
+		}))
+		printUsageTable("MODEL", summarizeUsage(records, func(r gpt4client.UsageRecord) string {
+			return r.Provider + "/" + r.Model
+		}))
+	},
+}
+
+func init() {
+	usageCmd.Flags().Int("days", 0, "Only include the last N days (0 for all recorded usage)")
+	rootCmd.AddCommand(usageCmd)
+}
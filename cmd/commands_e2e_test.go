@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ephemyral/pkg/llmtest"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+// runEphemyral runs the CLI with args against server, with all state kept in
+// temporary directories.
+func runEphemyral(t *testing.T, server *llmtest.Server, args ...string) {
+	setTestLLMSettings(t, server)
+	defer viper.Reset()
+
+	rootCmd.SetArgs(args)
+	require.NoError(t, rootCmd.ExecuteContext(context.Background()))
+}
+
+// configureTestLLM points the LLM client at server for tests that call
+// command functions directly.
+func configureTestLLM(t *testing.T, server *llmtest.Server) {
+	setTestLLMSettings(t, server)
+	t.Cleanup(viper.Reset)
+	require.NoError(t, configureLLM(rootCmd, nil))
+}
+
+func setTestLLMSettings(t *testing.T, server *llmtest.Server) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("EPHEMYRAL_HOME", t.TempDir())
+	t.Setenv("EPHEMYRAL_CACHE_DIR", t.TempDir())
+	t.Setenv("EPHEMYRAL_TEST_KEY", "test-key")
+
+	viper.Reset()
+	bindRootFlags()
+	viper.Set("api-url", server.URL())
+	viper.Set("api-key-env", "EPHEMYRAL_TEST_KEY")
+}
+
+func TestCreateWritesGeneratedFile(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Reply("```go\npackage main\n\nfunc main() {}\n```"))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "main.go")
+	require.NoError(t, os.WriteFile(path, nil, 0644))
+	runEphemyral(t, server, "create", path, "an empty main package")
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "package main\n\nfunc main() {}\n", string(content))
+
+	requests := server.Requests()
+	require.Len(t, requests, 1)
+	require.Contains(t, requests[0].Prompt(), "an empty main package")
+}
+
+func TestRefactorRewritesFile(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Reply("```go\npackage main\n\n// refactored\n```"))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "main.go")
+	require.NoError(t, os.WriteFile(path, []byte("package main\n"), 0644))
+	runEphemyral(t, server, "refactor", path, "add a comment")
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "package main\n\n// refactored\n", string(content))
+	require.Contains(t, server.Requests()[0].Prompt(), "package main")
+}
+
+func TestBuildStoresGeneratedCommand(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Replies(
+		"echo built",
+		`{"command": "echo built", "working_dir": "src", "prerequisites": ["echo"], "rationale": "nothing to compile"}`,
+	))
+	defer server.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "src"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "src", "main.go"), []byte("package main\n"), 0644))
+	runEphemyral(t, server, "build", dir)
+
+	command, err := getExistingCommand(dir, "build")
+	require.NoError(t, err)
+	require.Equal(t, "echo built", command)
+
+	ephemyral, err := readEphemyralFile(dir)
+	require.NoError(t, err)
+	require.Equal(t, CommandSettings{Command: "echo built", WorkingDir: "src", Prerequisites: []string{"echo"}, Rationale: "nothing to compile"}, ephemyral.Commands["build"])
+
+	requests := server.Requests()
+	require.Len(t, requests, 2)
+	require.Contains(t, requests[0].Prompt(), "main.go")
+	require.Contains(t, requests[1].Prompt(), "rejected")
+}
+
+func TestRunGeneratesNamedCommand(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Reply(`{"command": "echo bench", "working_dir": ".", "prerequisites": ["echo"], "rationale": "no benchmarks yet"}`))
+	defer server.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("version: 2\ncommands:\n  bench:\n    prompt: run the benchmarks\n"), 0644))
+	runEphemyral(t, server, "run", "bench", dir)
+
+	ephemyral, err := readEphemyralFile(dir)
+	require.NoError(t, err)
+	require.Equal(t, CommandSettings{Command: "echo bench", Prompt: "run the benchmarks", Prerequisites: []string{"echo"}, Rationale: "no benchmarks yet"}, ephemyral.Commands["bench"])
+	require.Contains(t, server.Requests()[0].Prompt(), "run the benchmarks")
+}
+
+func TestFailedRunReturnsError(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Reply("unused"))
+	defer server.Close()
+	setTestLLMSettings(t, server)
+	defer viper.Reset()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("version: 2\ncommands:\n  a:\n    command: 'true'\n    depends-on: [b]\n  b:\n    command: 'true'\n    depends-on: [a]\n"), 0644))
+	rootCmd.SetArgs([]string{"run", "a", dir})
+	require.ErrorContains(t, rootCmd.ExecuteContext(context.Background()), "dependency cycle")
+}
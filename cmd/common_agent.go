@@ -0,0 +1,465 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	gpt4client "ephemyral/pkg"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	maxToolOutput   = 16 * 1024
+	maxGrepMatches  = 100
+	maxGrepFileSize = 1 << 20
+)
+
+// agentTools are the tools offered to the model in automode.
+var agentTools = []gpt4client.Tool{
+	{
+		Name:        "read_file",
+		Description: "Read a file of the project.",
+		Parameters:  toolParameters(map[string]string{"path": "File path relative to the project root"}, "path"),
+	},
+	{
+		Name:        "list_files",
+		Description: "List the files of the project, or of one of its directories.",
+		Parameters:  toolParameters(map[string]string{"path": "Directory relative to the project root, \".\" for the root"}, "path"),
+	},
+	{
+		Name:        "write_file",
+		Description: "Create or overwrite a file of the project with the given content. The .ephemyral file and .git cannot be written.",
+		Parameters:  toolParameters(map[string]string{"path": "File path relative to the project root", "content": "The complete new file content"}, "path", "content"),
+	},
+	{
+		Name:        "run_command",
+		Description: "Run the stored build, test or lint command of the project and return its exit status and output.",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"type": map[string]interface{}{"type": "string", "enum": []string{"build", "test", "lint"}},
+			},
+			"required":             []string{"type"},
+			"additionalProperties": false,
+		},
+	},
+	{
+		Name:        "grep",
+		Description: "Search the files of the project for a regular expression and return the matching lines.",
+		Parameters:  toolParameters(map[string]string{"pattern": "Go regular expression", "path": "Directory or file relative to the project root, \".\" for the whole project"}, "pattern", "path"),
+	},
+}
+
+// toolParameters builds the JSON schema of a tool taking string arguments.
+func toolParameters(descriptions map[string]string, required ...string) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for name, description := range descriptions {
+		properties[name] = map[string]interface{}{"type": "string", "description": description}
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// agent executes tool calls inside a single project directory.
+type agent struct {
+	root        string
+	convID      uuid.UUID
+	log         *os.File
+	testsPassed bool
+}
+
+// agentLogEntry is one line of the automode tool call log.
+type agentLogEntry struct {
+	Time      time.Time `json:"time"`
+	Tool      string    `json:"tool"`
+	Arguments string    `json:"arguments"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// runAutomode lets the model work on the project at root with tools until
+// the stored test command passes or iterations model turns have been used.
+// It reports whether the tests pass, which is false when the project has no
+// test command. Old tool results are shortened by gpt4client.Chat when the
+// conversation outgrows the context window.
+func runAutomode(ctx context.Context, root, userPrompt string, convID uuid.UUID, iterations int) bool {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		printPanel(fmt.Sprintf("Error resolving project directory: %s", err), "Automode", "red")
+		return false
+	}
+
+	a := &agent{root: root, convID: convID}
+	if logPath, err := a.openLog(); err != nil {
+		fmt.Println("Warning: not logging tool calls:", err)
+	} else {
+		defer a.log.Close()
+		printPanel(logPath, "Automode log", "cyan")
+	}
+
+	messages := []gpt4client.Message{gpt4client.UserMessage(fmt.Sprintf(AutomodePrompt, userPrompt))}
+	for i := 0; i < iterations; i++ {
+		fmt.Println("Automode iteration:", i+1)
+		resp, err := gpt4client.Chat(ctx, "automode", convID, messages, agentTools)
+		if err != nil {
+			if ctx.Err() != nil {
+				printPanel("Automode interrupted.", "Automode", "yellow")
+			} else {
+				printPanel(fmt.Sprintf("Error from LLM: %s", err), "Automode", "red")
+			}
+			return false
+		}
+		messages = append(messages, resp.Message())
+		if strings.TrimSpace(resp.Content) != "" {
+			fmt.Println(resp.Content)
+		}
+
+		if len(resp.ToolCalls) == 0 {
+			output, err := a.runStoredCommand(ctx, "test")
+			if err == nil {
+				printPanel("Automode completed, tests pass.", "Automode", "green")
+				return true
+			}
+			if errors.Is(err, errNoTestCommand) {
+				printPanel("Automode completed, but no tests were run: no test command is configured.", "Automode", "yellow")
+				return false
+			}
+			if ctx.Err() != nil {
+				printPanel("Automode interrupted.", "Automode", "yellow")
+				return false
+			}
+			messages = append(messages, gpt4client.UserMessage(fmt.Sprintf(AutomodeTestsFailedPrompt, output)))
+			continue
+		}
+
+		for _, call := range resp.ToolCalls {
+			messages = append(messages, gpt4client.ToolResult(call, a.call(ctx, call)))
+		}
+		if a.testsPassed {
+			printPanel("Automode completed, tests pass.", "Automode", "green")
+			return true
+		}
+	}
+	printPanel(fmt.Sprintf("Automode stopped after %d iterations without passing tests.", iterations), "Automode", "yellow")
+	return false
+}
+
+// openLog opens the tool call log of the conversation for appending.
+func (a *agent) openLog() (string, error) {
+	dir, err := gpt4client.StateDir()
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "automode", a.convID.String()+".jsonl")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	a.log, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	return path, err
+}
+
+// call runs one tool call, logs it and returns the result for the model.
+func (a *agent) call(ctx context.Context, call gpt4client.ToolCall) string {
+	var result string
+	var args map[string]string
+	err := json.Unmarshal([]byte(firstNonEmpty(call.Arguments, "{}")), &args)
+	if err != nil {
+		err = fmt.Errorf("invalid arguments: %v", err)
+	} else {
+		result, err = a.dispatch(ctx, call.Name, args)
+	}
+
+	fmt.Printf("[tool] %s %s: %s\n", call.Name, call.Arguments, toolSummary(result, err))
+	if a.log != nil {
+		entry := agentLogEntry{Time: time.Now(), Tool: call.Name, Arguments: call.Arguments, Result: truncateOutput(result)}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		if data, jsonErr := json.Marshal(entry); jsonErr == nil {
+			a.log.Write(append(data, '\n'))
+		}
+	}
+
+	if err != nil {
+		return strings.TrimSpace("Error: " + err.Error() + "\n" + truncateOutput(result))
+	}
+	return truncateOutput(result)
+}
+
+func (a *agent) dispatch(ctx context.Context, tool string, args map[string]string) (string, error) {
+	switch tool {
+	case "read_file":
+		return a.readFile(args["path"])
+	case "list_files":
+		return a.listFiles(args["path"])
+	case "write_file":
+		return a.writeFile(args["path"], args["content"])
+	case "run_command":
+		return a.runCommandTool(ctx, args["type"])
+	case "grep":
+		return a.grep(args["pattern"], args["path"])
+	default:
+		return "", fmt.Errorf("unknown tool %q", tool)
+	}
+}
+
+// resolve returns the absolute path of path inside the project, rejecting
+// paths that leave it, also through symbolic links.
+func (a *agent) resolve(path string) (string, error) {
+	path = filepath.Clean(firstNonEmpty(path, "."))
+	if filepath.IsAbs(path) {
+		rel, err := filepath.Rel(a.root, path)
+		if err != nil {
+			return "", err
+		}
+		path = rel
+	}
+	if !filepath.IsLocal(path) && path != "." {
+		return "", fmt.Errorf("path %q is outside the project directory", path)
+	}
+
+	full := filepath.Join(a.root, path)
+	root, err := filepath.EvalSymlinks(a.root)
+	if err != nil {
+		return "", err
+	}
+	// Resolve the longest existing prefix, since the file may not exist yet.
+	existing := full
+	for {
+		if _, err := os.Lstat(existing); err == nil || existing == a.root {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, real); err != nil || (rel != "." && !filepath.IsLocal(rel)) {
+		return "", fmt.Errorf("path %q is outside the project directory", path)
+	}
+	return full, nil
+}
+
+// resolveWritable is resolve for write_file, which must not change the
+// .ephemyral file or anything inside .git: the model could replace the test
+// command that decides whether it succeeded, or install git hooks.
+func (a *agent) resolveWritable(path string) (string, error) {
+	full, err := a.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	rel, _ := filepath.Rel(a.root, full)
+	if root, err := filepath.EvalSymlinks(a.root); err == nil {
+		if real, err := filepath.EvalSymlinks(full); err == nil {
+			if realRel, err := filepath.Rel(root, real); err == nil && isProtectedPath(realRel) {
+				rel = realRel
+			}
+		}
+	}
+	if isProtectedPath(rel) {
+		return "", fmt.Errorf("path %q cannot be written: .ephemyral and .git are managed by ephemyral and git", path)
+	}
+	return full, nil
+}
+
+// isProtectedPath reports whether rel, relative to the project, is a
+// .ephemyral file or inside a .git directory.
+func isProtectedPath(rel string) bool {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for _, part := range parts {
+		if strings.EqualFold(part, ".git") {
+			return true
+		}
+	}
+	return strings.EqualFold(parts[len(parts)-1], ".ephemyral")
+}
+
+func (a *agent) readFile(path string) (string, error) {
+	full, err := a.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(full)
+	return string(data), err
+}
+
+func (a *agent) listFiles(path string) (string, error) {
+	full, err := a.resolve(path)
+	if err != nil {
+		return "", err
+	}
+	files, err := getFileList(full)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(uniqueFiles(files), "\n"), nil
+}
+
+func (a *agent) writeFile(path, content string) (string, error) {
+	full, err := a.resolveWritable(path)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(full, []byte(content), 0644); err != nil {
+		return "", err
+	}
+	a.testsPassed = false
+	return fmt.Sprintf("wrote %d bytes to %s", len(content), path), nil
+}
+
+func (a *agent) runCommandTool(ctx context.Context, commandType string) (string, error) {
+	switch commandType {
+	case "build", "test", "lint":
+	default:
+		return "", fmt.Errorf("unknown command type %q", commandType)
+	}
+	output, err := a.runStoredCommand(ctx, commandType)
+	if errors.Is(err, errNoTestCommand) {
+		return output, nil
+	}
+	if err != nil {
+		return output, err
+	}
+	if commandType == "test" {
+		a.testsPassed = true
+	}
+	return output, nil
+}
+
+// errNoTestCommand is returned by runStoredCommand when the project has no
+// test command, so no tests can be run.
+var errNoTestCommand = errors.New("no test command is configured")
+
+// runStoredCommand runs the command of commandType stored in .ephemyral and
+// returns its combined output.
+func (a *agent) runStoredCommand(ctx context.Context, commandType string) (string, error) {
+	command, err := getExistingCommand(a.root, commandType)
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(command) == "" {
+		if commandType == "test" {
+			return "no test command is configured, so no tests were run", errNoTestCommand
+		}
+		return "", fmt.Errorf("no %s command is configured; run 'ephemyral %s' first", commandType, commandType)
+	}
+
+	opts, err := execOptionsFor(a.root, commandType)
+	if err != nil {
+		return "", err
+	}
+	if err := authorizeCommand(a.root, opts.dir(a.root), command, "automode, "+storedOrigin(commandType)); err != nil {
+		return err.Error(), err
+	}
+	showEnv(os.Stdout, commandType, opts.env)
+	fmt.Printf("Running %s command: %s\n", commandType, command)
+	var output bytes.Buffer
+	if _, err := runCommandWithOptions(ctx, a.root, command, opts, &output, &output); err != nil {
+		return fmt.Sprintf("%s\n%s", err, truncateOutput(output.String())), fmt.Errorf("%s command failed: %v", commandType, err)
+	}
+	return "exit status 0\n" + truncateOutput(output.String()), nil
+}
+
+func (a *agent) grep(pattern, path string) (string, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", err
+	}
+	full, err := a.resolve(path)
+	if err != nil {
+		return "", err
+	}
+
+	var files []string
+	if info, err := os.Stat(full); err != nil {
+		return "", err
+	} else if info.IsDir() {
+		if files, err = getFileList(full); err != nil {
+			return "", err
+		}
+		files = uniqueFiles(files)
+	} else {
+		files, full = []string{filepath.Base(full)}, filepath.Dir(full)
+	}
+
+	var matches []string
+	for _, file := range files {
+		matches = append(matches, grepFile(re, filepath.Join(full, file), a.relative(filepath.Join(full, file)), maxGrepMatches-len(matches))...)
+		if len(matches) >= maxGrepMatches {
+			matches = append(matches, fmt.Sprintf("(stopped after %d matches)", maxGrepMatches))
+			break
+		}
+	}
+	if len(matches) == 0 {
+		return "no matches", nil
+	}
+	return strings.Join(matches, "\n"), nil
+}
+
+// grepFile returns up to limit matching lines of a text file as
+// "name:line: text".
+func grepFile(re *regexp.Regexp, path, name string, limit int) []string {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() > maxGrepFileSize {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+		return nil
+	}
+
+	var matches []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxGrepFileSize)
+	for line := 1; scanner.Scan() && len(matches) < limit; line++ {
+		if re.Match(scanner.Bytes()) {
+			matches = append(matches, fmt.Sprintf("%s:%d: %s", name, line, scanner.Text()))
+		}
+	}
+	return matches
+}
+
+func (a *agent) relative(path string) string {
+	if rel, err := filepath.Rel(a.root, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// truncateOutput keeps the end of long tool output, which usually holds the
+// errors.
+func truncateOutput(s string) string {
+	if len(s) <= maxToolOutput {
+		return s
+	}
+	return fmt.Sprintf("(first %d bytes omitted)\n%s", len(s)-maxToolOutput, s[len(s)-maxToolOutput:])
+}
+
+// toolSummary describes a tool result in one line for the console.
+func toolSummary(result string, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	lines := strings.Count(result, "\n") + 1
+	return fmt.Sprintf("ok (%d bytes, %d lines)", len(result), lines)
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ephemyral/pkg/llmtest"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentPathsStayInsideProject(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "link")))
+	a := &agent{root: root}
+
+	for _, path := range []string{".", "main.go", "new/dir/file.go"} {
+		_, err := a.resolve(path)
+		require.NoError(t, err, path)
+	}
+	for _, path := range []string{"..", "../x", outside, "link/file.go"} {
+		_, err := a.resolve(path)
+		require.Error(t, err, path)
+	}
+}
+
+func TestAgentCannotWriteProjectConfigOrGit(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, ".ephemyral"), []byte("test-command: go test ./...\n"), 0644))
+	require.NoError(t, os.Symlink(".ephemyral", filepath.Join(root, "config.yaml")))
+	a := &agent{root: root}
+
+	for _, path := range []string{".ephemyral", "sub/.ephemyral", ".git/hooks/pre-commit", "sub/.git/config", ".GIT/config", "config.yaml"} {
+		_, err := a.writeFile(path, "test-command: \"true\"\n")
+		require.Error(t, err, path)
+	}
+	data, err := os.ReadFile(filepath.Join(root, ".ephemyral"))
+	require.NoError(t, err)
+	require.Equal(t, "test-command: go test ./...\n", string(data))
+	require.NoDirExists(t, filepath.Join(root, ".git"))
+
+	_, err = a.writeFile(".github/workflows/ci.yml", "on: push\n")
+	require.NoError(t, err)
+	_, err = a.readFile(".ephemyral")
+	require.NoError(t, err)
+}
+
+func TestAutomodeIteratesUntilTestsPass(t *testing.T) {
+	server := llmtest.NewToolServer(func(req llmtest.Request) llmtest.Answer {
+		results := 0
+		for _, m := range req.Messages {
+			if m.Role == "tool" {
+				results++
+			}
+		}
+		switch results {
+		case 0:
+			return llmtest.Answer{ToolCalls: []llmtest.ToolCall{{Name: "list_files", Arguments: `{"path": "."}`}}}
+		case 1:
+			return llmtest.Answer{ToolCalls: []llmtest.ToolCall{{Name: "write_file", Arguments: `{"path": "done.txt", "content": "ok"}`}}}
+		default:
+			return llmtest.Answer{ToolCalls: []llmtest.ToolCall{{Name: "run_command", Arguments: `{"type": "test"}`}}}
+		}
+	})
+	defer server.Close()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("test-command: test -f done.txt\n"), 0644))
+	configureTestLLM(t, server)
+
+	require.True(t, runAutomode(context.Background(), dir, "create done.txt", uuid.New(), 5))
+	content, err := os.ReadFile(filepath.Join(dir, "done.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(content))
+	require.Len(t, server.Requests(), 3)
+}
+
+func TestAutomodeReportsMissingTestCommand(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Reply("Nothing to do."))
+	defer server.Close()
+	configureTestLLM(t, server)
+
+	require.False(t, runAutomode(context.Background(), t.TempDir(), "do nothing", uuid.New(), 3))
+	require.Len(t, server.Requests(), 1)
+}
@@ -0,0 +1,206 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	gpt4client "ephemyral/pkg"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Approval modes for running commands: ask for every command, ask only for
+// commands that were not approved before, or never ask.
+const (
+	ApproveAlways = "always"
+	ApproveNew    = "new"
+	ApproveNever  = "never"
+)
+
+var (
+	// errCommandDeclined is returned when the user does not approve a command.
+	errCommandDeclined = errors.New("command not approved")
+	// errDryRun is returned instead of running a command with --dry-run.
+	errDryRun = errors.New("dry run: command not executed")
+)
+
+// approvalInput is where confirmations are read from.
+var approvalInput = bufio.NewReader(os.Stdin)
+
+// approvalMu serializes questions and updates of the approved commands by
+// commands that run in parallel.
+var approvalMu sync.Mutex
+
+// approvalMode returns the configured approval mode.
+func approvalMode() (string, error) {
+	switch mode := strings.ToLower(viper.GetString("approve")); mode {
+	case "", ApproveNever:
+		return ApproveNever, nil
+	case ApproveAlways, ApproveNew:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid approve mode %q: use always, new or never", mode)
+	}
+}
+
+// isNotExecuted reports whether err means that a command was held back by
+// the shell policy or the approval gate, so running it again is pointless.
+func isNotExecuted(err error) bool {
+	return errors.Is(err, errCommandDeclined) || errors.Is(err, errDryRun) || isPolicyViolation(err)
+}
+
+// commandHash identifies a command line running in workDir, a directory of
+// the project, in the approved commands.
+func commandHash(directory, workDir, command string) string {
+	if rel, err := filepath.Rel(directory, workDir); err == nil {
+		workDir = filepath.ToSlash(rel)
+	}
+	sum := sha256.Sum256([]byte(workDir + "\x00" + strings.TrimSpace(command)))
+	return hex.EncodeToString(sum[:])
+}
+
+// approvalsPath returns the file holding the approved commands of the user.
+// They are kept out of the project, so a checkout cannot approve its own
+// commands.
+func approvalsPath() (string, error) {
+	dir, err := gpt4client.StateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "approvals.json"), nil
+}
+
+// readApprovals returns the hashes of the approved commands by absolute
+// project directory.
+func readApprovals() (map[string][]string, error) {
+	path, err := approvalsPath()
+	if err != nil {
+		return nil, err
+	}
+	approvals := map[string][]string{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return approvals, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &approvals); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return approvals, nil
+}
+
+// writeApprovals replaces the approved commands of the user.
+func writeApprovals(approvals map[string][]string) error {
+	path, err := approvalsPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(approvals, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// authorizeCommand checks command against the shell policy and then asks for
+// approval. It must pass before a command runs.
+func authorizeCommand(directory, workDir, command, origin string) error {
+	if err := checkShellPolicyIn(directory, workDir, command); err != nil {
+		fmt.Println("Refusing to run:", strings.TrimSpace(command))
+		return err
+	}
+	return approveCommand(directory, workDir, command, origin)
+}
+
+// approveCommand shows command, where it came from and where it runs, and
+// asks for confirmation when the approval mode requires it. Approved commands
+// are remembered per user for the project directory and working directory.
+func approveCommand(directory, workDir, command, origin string) error {
+	mode, err := approvalMode()
+	if err != nil {
+		return err
+	}
+	dryRun := viper.GetBool("dry-run")
+	if mode == ApproveNever && !dryRun {
+		return nil
+	}
+	// One question at a time, and one update of the approved commands.
+	approvalMu.Lock()
+	defer approvalMu.Unlock()
+
+	// Approvals given in a scratch copy belong to its project.
+	project, _, err := projectPath(directory)
+	if err != nil {
+		return err
+	}
+	projectWorkDir, _, err := projectPath(workDir)
+	if err != nil {
+		return err
+	}
+	approvals, err := readApprovals()
+	if err != nil {
+		return wrapError(err, "reading approved commands")
+	}
+	hash := commandHash(project, projectWorkDir, command)
+	approved := containsString(approvals[project], hash)
+
+	fmt.Println("Command:    ", strings.TrimSpace(command))
+	fmt.Println("Origin:     ", origin)
+	fmt.Println("Working dir:", workDir)
+	if dryRun {
+		return errDryRun
+	}
+	if mode == ApproveNew && approved {
+		fmt.Println("Previously approved.")
+		return nil
+	}
+
+	if !confirm("Run this command? [y/N] ") {
+		return errCommandDeclined
+	}
+	if approved {
+		return nil
+	}
+	approvals[project] = append(approvals[project], hash)
+	return wrapError(writeApprovals(approvals), "saving approved command")
+}
+
+// confirm prints question and reports whether the answer is yes.
+func confirm(question string) bool {
+	fmt.Print(question)
+	answer, err := approvalInput.ReadString('\n')
+	if err != nil && answer == "" {
+		fmt.Println()
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	default:
+		return false
+	}
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
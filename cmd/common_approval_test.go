@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func setApprovalInput(t *testing.T, input string) {
+	previous := approvalInput
+	approvalInput = bufio.NewReader(strings.NewReader(input))
+	t.Cleanup(func() { approvalInput = previous })
+}
+
+func TestApproveNewRemembersApprovedCommands(t *testing.T) {
+	t.Setenv("EPHEMYRAL_HOME", t.TempDir())
+	viper.Set("approve", ApproveNew)
+	defer viper.Reset()
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+
+	setApprovalInput(t, "n\n")
+	require.ErrorIs(t, approveCommand(dir, dir, "echo hi", "test"), errCommandDeclined)
+
+	setApprovalInput(t, "y\n")
+	require.NoError(t, approveCommand(dir, dir, "echo hi", "test"))
+
+	// Approved before, so no answer is needed.
+	setApprovalInput(t, "")
+	require.NoError(t, approveCommand(dir, dir, "echo hi", "test"))
+	require.ErrorIs(t, approveCommand(dir, dir, "echo bye", "test"), errCommandDeclined)
+	// The approval does not cover other working directories.
+	require.ErrorIs(t, approveCommand(dir, filepath.Join(dir, "sub"), "echo hi", "test"), errCommandDeclined)
+
+	approvals, err := readApprovals()
+	require.NoError(t, err)
+	require.Equal(t, map[string][]string{dir: {commandHash(dir, dir, "echo hi")}}, approvals)
+	require.NoFileExists(t, filepath.Join(dir, ".ephemyral"))
+}
+
+func TestDryRunDoesNotExecute(t *testing.T) {
+	viper.Set("dry-run", true)
+	defer viper.Reset()
+	dir := t.TempDir()
+
+	_, err := executeWithRetries(context.Background(), dir, "touch ran", "build", "test", uuid.New(), 3, 0)
+	require.ErrorIs(t, err, errDryRun)
+	_, err = os.Stat(filepath.Join(dir, "ran"))
+	require.True(t, os.IsNotExist(err))
+}
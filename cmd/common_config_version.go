@@ -0,0 +1,235 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// currentConfigVersion is the layout of the .ephemyral files this version of
+// ephemyral reads and writes. Files without a version key have version 1.
+const currentConfigVersion = 2
+
+// configMigration upgrades a .ephemyral document from version From to From+1.
+type configMigration struct {
+	From        int
+	Description string
+	Apply       func(root *yaml.Node) error
+}
+
+// configMigrations is the migration chain, oldest first.
+var configMigrations = []configMigration{
+	{From: 1, Description: "move build-command, test-command, lint-command, docs-command and rationales into the commands map and drop approved-commands", Apply: migrateBuiltinCommands},
+}
+
+// parseEphemyralDocument parses a .ephemyral file and returns the document
+// node, whose only child is the top-level mapping, and its version.
+func parseEphemyralDocument(data []byte) (*yaml.Node, int, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, 0, err
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, 0, fmt.Errorf("line %d: the file must be a mapping of keys to values", root.Line)
+	}
+
+	version := 1
+	if value := mappingValue(root, "version"); value != nil {
+		n, err := strconv.Atoi(value.Value)
+		if value.Kind != yaml.ScalarNode || err != nil || n < 1 {
+			return nil, 0, fmt.Errorf("line %d: invalid version %q", value.Line, value.Value)
+		}
+		version = n
+	}
+	if version > currentConfigVersion {
+		return nil, 0, fmt.Errorf("version %d is newer than the version %d this ephemyral supports; upgrade ephemyral", version, currentConfigVersion)
+	}
+	return &doc, version, nil
+}
+
+// migrateEphemyralDocument applies the migrations from version on to doc and
+// returns their descriptions.
+func migrateEphemyralDocument(doc *yaml.Node, version int) ([]string, error) {
+	root := doc.Content[0]
+	var applied []string
+	for _, migration := range configMigrations {
+		if migration.From < version {
+			continue
+		}
+		if err := migration.Apply(root); err != nil {
+			return nil, fmt.Errorf("migrating from version %d: %v", migration.From, err)
+		}
+		applied = append(applied, fmt.Sprintf("version %d to %d: %s", migration.From, migration.From+1, migration.Description))
+	}
+	if len(applied) > 0 {
+		removeMappingKey(root, "version")
+		key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "version"}
+		if len(root.Content) > 0 {
+			// The comment at the top of the file stays there.
+			key.HeadComment, root.Content[0].HeadComment = root.Content[0].HeadComment, ""
+		}
+		root.Content = append([]*yaml.Node{key, {Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(currentConfigVersion)}}, root.Content...)
+	}
+	return applied, nil
+}
+
+// migrateBuiltinCommands moves the commands of the built-in types into the
+// commands map. An entry that already has a command keeps it, since it took
+// precedence before. The rationales map is folded into the entries, and
+// approved-commands is dropped since approvals are kept per user.
+func migrateBuiltinCommands(root *yaml.Node) error {
+	removeMappingKey(root, "approved-commands")
+	for _, name := range []string{"build", "test", "lint", "docs"} {
+		value := mappingValue(root, name+"-command")
+		if value == nil {
+			continue
+		}
+		if value.Kind != yaml.ScalarNode {
+			return fmt.Errorf("line %d: %s-command must be a string", value.Line, name)
+		}
+		removeMappingKey(root, name+"-command")
+		if strings.TrimSpace(value.Value) == "" {
+			continue
+		}
+
+		commands := mappingValue(root, "commands")
+		if commands == nil {
+			commands = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "commands"}, commands)
+		}
+		entry := mappingValue(commands, name)
+		if entry == nil || entry.Tag == "!!null" {
+			if entry == nil {
+				entry = &yaml.Node{}
+				commands.Content = append(commands.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name}, entry)
+			}
+			*entry = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		if entry.Kind != yaml.MappingNode {
+			return fmt.Errorf("line %d: commands.%s must be a mapping", entry.Line, name)
+		}
+		if mappingValue(entry, "command") == nil {
+			entry.Content = append([]*yaml.Node{{Kind: yaml.ScalarNode, Tag: "!!str", Value: "command"}, value}, entry.Content...)
+		}
+	}
+	return migrateRationales(root)
+}
+
+// migrateRationales moves every entry of the rationales map next to the
+// command it explains. Rationales of commands that are not stored are dropped.
+func migrateRationales(root *yaml.Node) error {
+	rationales := mappingValue(root, "rationales")
+	if rationales == nil {
+		return nil
+	}
+	if rationales.Kind != yaml.MappingNode && rationales.Tag != "!!null" {
+		return fmt.Errorf("line %d: rationales must be a mapping", rationales.Line)
+	}
+	removeMappingKey(root, "rationales")
+
+	commands := mappingValue(root, "commands")
+	for i := 0; i+1 < len(rationales.Content); i += 2 {
+		name, rationale := rationales.Content[i].Value, rationales.Content[i+1]
+		if commands == nil || rationale.Kind != yaml.ScalarNode {
+			continue
+		}
+		entry := mappingValue(commands, name)
+		if entry == nil || entry.Kind != yaml.MappingNode || mappingValue(entry, "rationale") != nil {
+			continue
+		}
+		entry.Content = append(entry.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "rationale"}, rationale)
+	}
+	return nil
+}
+
+// decodeEphemyralFile decodes data strictly: unknown keys are errors that
+// name the file and line.
+func decodeEphemyralFile(data []byte, path string) (EphemyralFile, error) {
+	var ephemyral EphemyralFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(&ephemyral)
+	if errors.Is(err, io.EOF) {
+		return ephemyral, nil
+	}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages := make([]string, len(typeErr.Errors))
+		for i, message := range typeErr.Errors {
+			if match := unknownFieldPattern.FindStringSubmatch(message); match != nil {
+				messages[i] = fmt.Sprintf("%s:%s: unknown key %q", path, match[1], match[2])
+			} else {
+				messages[i] = path + ": " + message
+			}
+		}
+		return ephemyral, errors.New(strings.Join(messages, "\n"))
+	}
+	return ephemyral, err
+}
+
+// unknownFieldPattern matches the yaml.v3 error for an unknown key.
+var unknownFieldPattern = regexp.MustCompile(`^line (\d+): field (\S+) not found in type \S+$`)
+
+// encodeYAML formats v like the .ephemyral files ephemyral writes.
+func encodeYAML(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// backupEphemyralFile saves data, the content of the .ephemyral file at path
+// with the given version, next to it and returns the backup path.
+func backupEphemyralFile(path string, data []byte, version int) (string, error) {
+	backup := fmt.Sprintf("%s.v%d.bak", path, version)
+	perm := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	return backup, writeFileAtomic(backup, data, perm)
+}
+
+// mappingValue returns the value of key in the mapping node, or nil.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// removeMappingKey removes key and its value from the mapping node. The
+// comment above the key is kept above the next one.
+func removeMappingKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			if comment := mapping.Content[i].HeadComment; comment != "" && i+2 < len(mapping.Content) {
+				next := mapping.Content[i+2]
+				next.HeadComment = strings.TrimSpace(comment + "\n" + next.HeadComment)
+			}
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// EnvPolicySettings controls which variables of the ephemyral process are
+// passed on to the commands it runs.
+type EnvPolicySettings struct {
+	// Passthrough adds variables to the default allow-list. A trailing *
+	// matches any suffix.
+	Passthrough []string `yaml:"passthrough,omitempty" mapstructure:"passthrough"`
+	// Deny adds variables that are always removed.
+	Deny []string `yaml:"deny,omitempty" mapstructure:"deny"`
+	// InheritAll passes every variable that is not denied.
+	InheritAll bool `yaml:"inherit-all,omitempty" mapstructure:"inherit-all"`
+}
+
+// defaultPassthroughEnv are the variables commands see by default: what
+// shells and common toolchains need to find programs, caches and proxies.
+var defaultPassthroughEnv = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TERM", "LANG", "LANGUAGE", "LC_*", "TZ",
+	"TMPDIR", "TMP", "TEMP", "XDG_*",
+	"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "SSL_CERT_FILE", "SSL_CERT_DIR",
+	"GOPATH", "GOROOT", "GOCACHE", "GOMODCACHE", "GOFLAGS", "GOPROXY", "GOPRIVATE", "GOTOOLCHAIN", "CGO_ENABLED",
+	"CC", "CXX", "CFLAGS", "CXXFLAGS", "LDFLAGS", "PKG_CONFIG_PATH",
+	"JAVA_HOME", "MAVEN_HOME", "GRADLE_HOME", "NODE_PATH", "NVM_DIR", "PYTHONPATH", "VIRTUAL_ENV", "CONDA_PREFIX",
+	"CARGO_HOME", "RUSTUP_HOME", "DOTNET_ROOT", "CI",
+	"SYSTEMROOT", "COMSPEC", "PATHEXT", "WINDIR", "USERPROFILE", "APPDATA", "LOCALAPPDATA", "PROGRAMFILES*", "PROGRAMDATA",
+}
+
+// providerCredentialEnv are always removed, together with the variable named
+// by api-key-env.
+var providerCredentialEnv = []string{"OPENAI_API_KEY", "ANTHROPIC_API_KEY", "OLLAMA_API_KEY"}
+
+// execOptions controls the process of a command of one type. A nil sandbox
+// runs it locally; an empty workingDir runs it in the project directory and
+// an empty shell runs it with bash.
+type execOptions struct {
+	limits     commandLimits
+	env        []string
+	sandbox    *sandboxOptions
+	workingDir string
+	shell      string
+}
+
+// execOptionsFor reads the limits, environment, executor, working directory
+// and shell of commandType from the .ephemyral file in directory.
+func execOptionsFor(directory, commandType string) (execOptions, error) {
+	ephemyral, err := readEphemyralFile(directory)
+	if err != nil {
+		return execOptions{}, err
+	}
+	settings := ephemyral.Commands[commandType]
+	limits, err := ephemyral.Limits[commandType].parse()
+	if err == nil && settings.Timeout != "" {
+		limits.Timeout, err = time.ParseDuration(settings.Timeout)
+		if err == nil && limits.Timeout < 0 {
+			err = errors.New("negative timeout")
+		}
+	}
+	if err != nil {
+		return execOptions{}, wrapError(err, "parsing limits of the "+commandType+" command")
+	}
+	sandbox, err := sandboxOptionsFor(directory, commandType)
+	if err != nil {
+		return execOptions{}, err
+	}
+	workingDir, err := commandWorkingDir(directory, settings.WorkingDir)
+	if err != nil {
+		return execOptions{}, wrapError(err, "reading the working-dir of the "+commandType+" command")
+	}
+	return execOptions{limits: limits, env: commandEnv(ephemyral, commandType), sandbox: sandbox, workingDir: workingDir, shell: settings.Shell}, nil
+}
+
+// commandWorkingDir resolves the working-dir of a command, which must be a
+// directory inside the project.
+func commandWorkingDir(directory, workingDir string) (string, error) {
+	if workingDir == "" || workingDir == "." {
+		return "", nil
+	}
+	if !filepath.IsLocal(workingDir) {
+		return "", fmt.Errorf("%s is not a relative path inside the project", workingDir)
+	}
+	path, err := filepath.Abs(filepath.Join(directory, workingDir))
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(path); err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", workingDir)
+	}
+	return path, nil
+}
+
+// dir returns where the command runs.
+func (o execOptions) dir(directory string) string {
+	if o.workingDir != "" {
+		return o.workingDir
+	}
+	return directory
+}
+
+// shellCmd returns the shell that runs the command.
+func (o execOptions) shellCmd() string {
+	if o.shell != "" {
+		return o.shell
+	}
+	return BashCmd
+}
+
+// envPolicy returns the configured environment policy. It is only taken from
+// the user config, see projectIgnoredSettings.
+func envPolicy() (EnvPolicySettings, error) {
+	var policy EnvPolicySettings
+	if err := viper.UnmarshalKey("env-policy", &policy); err != nil {
+		return EnvPolicySettings{}, wrapError(err, "parsing env-policy")
+	}
+	return policy, nil
+}
+
+// commandEnv returns the environment of a command of commandType: the
+// allowed variables of this process plus the env entries of the command,
+// without any denied variable.
+func commandEnv(ephemyral EphemyralFile, commandType string) []string {
+	// configureLLM reports a policy that cannot be parsed.
+	policy, _ := envPolicy()
+	allowed := append(append([]string{}, defaultPassthroughEnv...), policy.Passthrough...)
+	denied := append(append([]string{}, providerCredentialEnv...), policy.Deny...)
+	if name := viper.GetString("api-key-env"); name != "" {
+		denied = append(denied, name)
+	}
+
+	env := map[string]string{}
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if (policy.InheritAll || matchesEnvName(allowed, name)) && !matchesEnvName(denied, name) {
+			env[name] = value
+		}
+	}
+	for _, set := range []map[string]string{ephemyral.Env[commandType], ephemyral.Commands[commandType].Env} {
+		for name, value := range set {
+			if matchesEnvName(denied, name) {
+				fmt.Printf("Warning: not passing %s to the %s command, it is on the deny list\n", name, commandType)
+				continue
+			}
+			env[name] = value
+		}
+	}
+
+	result := make([]string, 0, len(env))
+	for name, value := range env {
+		result = append(result, name+"="+value)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// matchesEnvName reports whether name matches one of patterns. Names are
+// compared case-insensitively, as on Windows.
+func matchesEnvName(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// showEnv prints the environment a command will see when --show-env is set.
+func showEnv(out io.Writer, commandType string, env []string) {
+	if !viper.GetBool("show-env") {
+		return
+	}
+	fmt.Fprintf(out, "Environment of the %s command:\n", commandType)
+	for _, entry := range env {
+		fmt.Fprintln(out, "  "+entry)
+	}
+}
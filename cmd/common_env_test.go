@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCommandEnvScrubsCredentials(t *testing.T) {
+	t.Setenv("OPENAI_API_KEY", "sk-secret")
+	t.Setenv("MY_PROVIDER_KEY", "secret")
+	t.Setenv("UNLISTED_VAR", "x")
+	t.Setenv("EXTRA_ONE", "1")
+	t.Setenv("LC_ALL", "C")
+	viper.Set("api-key-env", "MY_PROVIDER_KEY")
+	viper.Set("env-policy", map[string]interface{}{"passthrough": []string{"EXTRA_*"}})
+	defer viper.Reset()
+
+	dir := t.TempDir()
+	config := "env:\n  build:\n    BUILD_MODE: release\n    OPENAI_API_KEY: leaked\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte(config), 0644))
+
+	opts, err := execOptionsFor(dir, "build")
+	require.NoError(t, err)
+	require.Contains(t, opts.env, "BUILD_MODE=release")
+	require.Contains(t, opts.env, "EXTRA_ONE=1")
+	require.Contains(t, opts.env, "LC_ALL=C")
+	require.Contains(t, opts.env, "PATH="+os.Getenv("PATH"))
+	for _, entry := range opts.env {
+		require.NotContains(t, entry, "OPENAI_API_KEY")
+		require.NotContains(t, entry, "MY_PROVIDER_KEY")
+		require.NotContains(t, entry, "UNLISTED_VAR")
+	}
+
+	var output bytes.Buffer
+	_, err = runCommandWithOptions(context.Background(), dir, `echo "key=$OPENAI_API_KEY mode=$BUILD_MODE"`, opts, &output, &output)
+	require.NoError(t, err)
+	require.Equal(t, "key= mode=release\n", output.String())
+}
+
+func TestInheritAllStillDeniesCredentials(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "secret")
+	t.Setenv("UNLISTED_VAR", "x")
+
+	viper.Set("env-policy", map[string]interface{}{"inherit-all": true})
+	defer viper.Reset()
+
+	env := commandEnv(EphemyralFile{}, "test")
+	require.Contains(t, env, "UNLISTED_VAR=x")
+	require.NotContains(t, env, "ANTHROPIC_API_KEY=secret")
+}
+
+func TestProjectFileCannotSetEnvPolicy(t *testing.T) {
+	t.Setenv("UNLISTED_VAR", "x")
+	viper.Reset()
+	defer viper.Reset()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("env-policy:\n  inherit-all: true\n  passthrough: [UNLISTED_*]\n"), 0644))
+	require.NoError(t, mergeProjectConfig(dir))
+
+	opts, err := execOptionsFor(dir, "build")
+	require.NoError(t, err)
+	require.NotContains(t, opts.env, "UNLISTED_VAR=x")
+}
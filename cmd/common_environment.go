@@ -0,0 +1,125 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// toolchainVersionArgs maps the toolchains reported in repair prompts to the
+// arguments that print their version.
+var toolchainVersionArgs = map[string][]string{
+	"go":      {"version"},
+	"gcc":     {"--version"},
+	"clang":   {"--version"},
+	"make":    {"--version"},
+	"cmake":   {"--version"},
+	"node":    {"--version"},
+	"npm":     {"--version"},
+	"yarn":    {"--version"},
+	"pnpm":    {"--version"},
+	"python":  {"--version"},
+	"python3": {"--version"},
+	"pip":     {"--version"},
+	"pip3":    {"--version"},
+	"pytest":  {"--version"},
+	"cargo":   {"--version"},
+	"rustc":   {"--version"},
+	"java":    {"-version"},
+	"javac":   {"-version"},
+	"mvn":     {"--version"},
+	"gradle":  {"--version"},
+	"dotnet":  {"--version"},
+	"ruby":    {"--version"},
+	"bundle":  {"--version"},
+	"php":     {"--version"},
+}
+
+// toolVersionTimeout bounds each version query.
+const toolVersionTimeout = 5 * time.Second
+
+// environmentInfo describes the OS and the toolchains that command uses, or
+// that are missing, for repair prompts.
+func environmentInfo(ctx context.Context, command string) string {
+	lines := []string{fmt.Sprintf("OS: %s/%s%s", runtime.GOOS, runtime.GOARCH, osRelease())}
+	for _, name := range commandNames(command) {
+		args, ok := toolchainVersionArgs[name]
+		if !ok {
+			continue
+		}
+		path, err := exec.LookPath(name)
+		if err != nil {
+			lines = append(lines, name+": not installed")
+			continue
+		}
+		lines = append(lines, name+": "+toolVersion(ctx, path, args))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// commandNames returns the distinct programs command runs, in order.
+func commandNames(command string) []string {
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(command), "")
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	syntax.Walk(file, func(node syntax.Node) bool {
+		if call, ok := node.(*syntax.CallExpr); ok {
+			if words := commandWords(call); len(words) > 0 {
+				if name := commandName(words[0]); name != "" && !containsString(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+		return true
+	})
+	return names
+}
+
+// toolVersion returns the first line printed by the version query of a tool.
+func toolVersion(ctx context.Context, path string, args []string) string {
+	ctx, cancel := context.WithTimeout(ctx, toolVersionTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Env = commandEnv(EphemyralFile{}, "")
+	out, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	if err != nil {
+		return "version unknown (" + err.Error() + ")"
+	}
+	return "version unknown"
+}
+
+// osRelease returns the distribution name on Linux, formatted as a suffix.
+func osRelease() string {
+	file, err := os.Open("/etc/os-release")
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "PRETTY_NAME="); ok {
+			return " (" + strings.Trim(value, `"`) + ")"
+		}
+	}
+	return ""
+}
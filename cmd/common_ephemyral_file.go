@@ -7,94 +7,236 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sync"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 // EphemyralFile represents the structure of the .ephemyral YAML file.
 type EphemyralFile struct {
+	// Version is the layout of the file, see currentConfigVersion.
+	Version      int    `yaml:"version,omitempty"`
 	OpenAIAPIKey string `yaml:"openai-api-key"`
-	BuildCommand string `yaml:"build-command"`
-	TestCommand  string `yaml:"test-command"`
-	LintCommand  string `yaml:"lint-command"`
-	DocsCommand  string `yaml:"docs-command"`
+	// The commands of the built-in types in version 1 files. They are moved
+	// into Commands when the file is written.
+	BuildCommand string `yaml:"build-command,omitempty"`
+	TestCommand  string `yaml:"test-command,omitempty"`
+	LintCommand  string `yaml:"lint-command,omitempty"`
+	DocsCommand  string `yaml:"docs-command,omitempty"`
+	// Commands holds the build, test, lint and docs commands and any other
+	// named command.
+	Commands map[string]CommandSettings `yaml:"commands,omitempty"`
+	// Approve is the approval mode for commands: always, new or never.
+	Approve string `yaml:"approve,omitempty"`
+	// Limits bounds the resources of commands, by command type.
+	Limits map[string]CommandLimitsSettings `yaml:"limits,omitempty"`
+	// Env sets variables for commands, by command type.
+	Env map[string]map[string]string `yaml:"env,omitempty"`
+	// EnvPolicy controls which variables commands inherit. It is only read
+	// from the user config.
+	EnvPolicy *EnvPolicySettings `yaml:"env-policy,omitempty"`
+	// Executor runs commands: local (the default) or sandbox. A project can
+	// only choose sandbox; its sandbox settings are ignored, since they would
+	// widen what commands may do.
+	Executor string           `yaml:"executor,omitempty"`
+	Sandbox  *SandboxSettings `yaml:"sandbox,omitempty"`
+	// Workspace is where refactor verifies changes: in-place (the default),
+	// copy or worktree.
+	Workspace string `yaml:"workspace,omitempty"`
+	// ShellPolicy restricts what commands may do.
+	ShellPolicy *ShellPolicySettings `yaml:"shell-policy,omitempty"`
+	LLMSettings `yaml:",inline"`
 }
 
+// CommandSettings is an entry of the commands map.
+type CommandSettings struct {
+	// Command is the shell command. It is generated on first use when empty.
+	Command string `yaml:"command,omitempty"`
+	// Prompt describes what the command should do, for generating it.
+	Prompt string `yaml:"prompt,omitempty"`
+	// WorkingDir is where the command runs, relative to the project.
+	WorkingDir string `yaml:"working-dir,omitempty"`
+	// Env sets variables for the command, over those of the env map.
+	Env map[string]string `yaml:"env,omitempty"`
+	// Timeout overrides the timeout of the limits map, e.g. 10m.
+	Timeout string `yaml:"timeout,omitempty"`
+	// Shell runs the command with -c instead of bash, e.g. sh or zsh.
+	Shell string `yaml:"shell,omitempty"`
+	// DependsOn names the commands that must succeed first.
+	DependsOn []string `yaml:"depends-on,omitempty"`
+	// Retry overrides the number of attempts of the command.
+	Retry int `yaml:"retry,omitempty"`
+	// Prerequisites are the programs the generated command needs.
+	Prerequisites []string `yaml:"prerequisites,omitempty"`
+	// Rationale records why the generated command was chosen.
+	Rationale string `yaml:"rationale,omitempty"`
+}
 
-// getExistingCommand reads the existing command from the .ephemyral file based on the key.
-func getExistingCommand(directory, key string) (string, error) {
-	filename := directory + "/.ephemyral"
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		return "", nil
-	}
+// ephemyralFileMu serializes updates of .ephemyral files by commands that
+// run in parallel.
+var ephemyralFileMu sync.Mutex
 
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return "", err
-	}
+// commandNamePattern matches valid command names, such as e2e or type-check.
+var commandNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
 
-	var ephemyral EphemyralFile
-	if err := yaml.Unmarshal(data, &ephemyral); err != nil {
-		return "", err
+// validateCommandName rejects names that cannot be used as command keys.
+func validateCommandName(name string) error {
+	if !commandNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid command name %q: use lowercase letters, digits, - and _", name)
 	}
+	return nil
+}
 
-	switch key {
+// builtinCommand returns the field holding the command of a built-in type,
+// or nil for other names.
+func (e *EphemyralFile) builtinCommand(name string) *string {
+	switch name {
 	case "build":
-		return ephemyral.BuildCommand, nil
+		return &e.BuildCommand
 	case "test":
-		return ephemyral.TestCommand, nil
+		return &e.TestCommand
 	case "lint":
-		return ephemyral.LintCommand, nil
+		return &e.LintCommand
 	case "docs":
-		return ephemyral.DocsCommand, nil
+		return &e.DocsCommand
 	default:
-		return "", fmt.Errorf("unknown key: %s", key)
+		return nil
 	}
 }
 
-// updateEphemyralFile updates the specified key in the .ephemyral file.
-func updateEphemyralFile(directory, key, command string) error {
-	filename := directory + "/.ephemyral"
-
-	var ephemyral EphemyralFile
-	if _, err := os.Stat(filename); !os.IsNotExist(err) {
-		data, err := os.ReadFile(filename)
-		if err != nil {
-			return err
-		}
+// command returns the stored command called name. An entry in the commands
+// map takes precedence over the built-in key.
+func (e *EphemyralFile) command(name string) string {
+	if entry := e.Commands[name]; entry.Command != "" {
+		return entry.Command
+	}
+	if field := e.builtinCommand(name); field != nil {
+		return *field
+	}
+	return ""
+}
 
-		if err := yaml.Unmarshal(data, &ephemyral); err != nil {
-			return err
-		}
+// setCommand stores the generated command called name in the commands map.
+func (e *EphemyralFile) setCommand(name string, generated GeneratedCommand) {
+	if field := e.builtinCommand(name); field != nil {
+		*field = ""
+	}
+	if e.Commands == nil {
+		e.Commands = map[string]CommandSettings{}
 	}
+	entry := e.Commands[name]
+	generated.store(&entry)
+	e.Commands[name] = entry
+}
 
-	switch key {
-	case "build":
-		ephemyral.BuildCommand = command
-	case "test":
-		ephemyral.TestCommand = command
-	case "lint":
-		ephemyral.LintCommand = command
-	case "docs":
-		ephemyral.DocsCommand = command
-	default:
-		return fmt.Errorf("unknown key: %s", key)
+
+// getExistingCommand reads the existing command from the .ephemyral file based on the key.
+func getExistingCommand(directory, key string) (string, error) {
+	if err := validateCommandName(key); err != nil {
+		return "", err
 	}
+	ephemyral, err := readEphemyralFile(directory)
+	if err != nil {
+		return "", err
+	}
+	return ephemyral.command(key), nil
+}
 
-	data, err := yaml.Marshal(&ephemyral)
+// updateEphemyralFile stores the generated command under the specified key in
+// the .ephemyral file, together with its working directory, prerequisites and
+// rationale.
+func updateEphemyralFile(directory, key string, generated GeneratedCommand) error {
+	if err := validateCommandName(key); err != nil {
+		return err
+	}
+	ephemyralFileMu.Lock()
+	defer ephemyralFileMu.Unlock()
+	ephemyral, err := readEphemyralFile(directory)
 	if err != nil {
 		return err
 	}
+	ephemyral.setCommand(key, generated)
 
-	if err := os.WriteFile(filename, data, 0644); err != nil {
+	if err := writeEphemyralFile(directory, ephemyral); err != nil {
 		fmt.Println("Error updating .ephemyral file:", err)
 		return err
 	}
+	if _, w, err := projectPath(directory); err == nil && w != nil {
+		// The command reaches the project once the change is verified.
+		w.stored[key] = generated
+	}
 
-	fmt.Printf("Successfully updated .ephemyral with %s command: %s\n", key, command)
+	fmt.Printf("Successfully updated .ephemyral with %s command: %s\n", key, generated.Command)
 	return nil
 }
 
+// readEphemyralFile reads the .ephemyral file in directory, migrated to the
+// current version. A missing file reads as an empty one; unknown keys are
+// errors.
+func readEphemyralFile(directory string) (EphemyralFile, error) {
+	ephemyral, _, err := loadEphemyralFile(directory)
+	return ephemyral, err
+}
+
+// loadEphemyralFile is readEphemyralFile that also returns the document the
+// file was decoded from, or nil for a missing file. An older file is migrated
+// in memory; it is upgraded on disk when a command is stored in it.
+func loadEphemyralFile(directory string) (EphemyralFile, *yaml.Node, error) {
+	path := filepath.Join(directory, ".ephemyral")
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return EphemyralFile{}, nil, nil
+	}
+	if err != nil {
+		return EphemyralFile{}, nil, err
+	}
+
+	doc, version, err := parseEphemyralDocument(data)
+	if err != nil {
+		return EphemyralFile{}, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if version == currentConfigVersion {
+		ephemyral, err := decodeEphemyralFile(data, path)
+		return ephemyral, doc, err
+	}
+	if _, err := migrateEphemyralDocument(doc, version); err != nil {
+		return EphemyralFile{}, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if data, err = encodeYAML(doc); err != nil {
+		return EphemyralFile{}, nil, err
+	}
+	ephemyral, err := decodeEphemyralFile(data, path)
+	if err != nil {
+		return ephemyral, nil, fmt.Errorf("%v\n(lines of the file migrated to version %d; run 'ephemyral config migrate' to upgrade it)", err, currentConfigVersion)
+	}
+	return ephemyral, doc, nil
+}
+
+// writeEphemyralFile replaces the .ephemyral file in directory with one of
+// the current version. A file of an older version is backed up first, as
+// 'ephemyral config migrate' does.
+func writeEphemyralFile(directory string, ephemyral EphemyralFile) error {
+	path := filepath.Join(directory, ".ephemyral")
+	ephemyral.Version = currentConfigVersion
+	data, err := encodeYAML(&ephemyral)
+	if err != nil {
+		return err
+	}
+
+	old, err := os.ReadFile(path)
+	if err == nil {
+		if _, version, err := parseEphemyralDocument(old); err == nil && version < currentConfigVersion {
+			backup, err := backupEphemyralFile(path, old, version)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Upgrading %s to version %d, the previous file is saved as %s\n", path, currentConfigVersion, backup)
+		}
+	}
+	return writeFileAtomic(path, data, 0644)
+}
+
 func findEphemyralDirectory(filePath string) (string, error) {
 	dir := filepath.Dir(filePath)
 
@@ -1,8 +1,11 @@
 package cmd
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
 )
 
@@ -17,3 +20,88 @@ func TestEphemyralFile(t *testing.T) {
 	require.Equal(t, "go test", testFile.TestCommand)
 	require.Equal(t, "golint", testFile.LintCommand)
 }
+
+func TestCommandsAreStoredInCommandsMap(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("test-command: go test ./...\ncommands:\n  lint:\n    command: golangci-lint run\n"), 0644))
+
+	require.NoError(t, updateEphemyralFile(dir, "test", GeneratedCommand{Command: "go test -race ./...", WorkingDir: "."}))
+	require.NoError(t, updateEphemyralFile(dir, "lint", GeneratedCommand{Command: "go vet ./...", WorkingDir: "."}))
+	require.NoError(t, updateEphemyralFile(dir, "bench", GeneratedCommand{Command: "go test -bench .", WorkingDir: "."}))
+
+	ephemyral, err := readEphemyralFile(dir)
+	require.NoError(t, err)
+	require.Equal(t, currentConfigVersion, ephemyral.Version)
+	require.Empty(t, ephemyral.TestCommand)
+	require.Equal(t, "go test -race ./...", ephemyral.Commands["test"].Command)
+	require.Equal(t, "go vet ./...", ephemyral.Commands["lint"].Command)
+	require.Equal(t, "go test -bench .", ephemyral.Commands["bench"].Command)
+
+	command, err := getExistingCommand(dir, "missing")
+	require.NoError(t, err)
+	require.Empty(t, command)
+	_, err = getExistingCommand(dir, "../build")
+	require.Error(t, err)
+}
+
+func TestOlderFilesAreMigratedWhenWritten(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	dir := t.TempDir()
+	original := "build-command: go build ./...\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte(original), 0644))
+
+	ephemyral, err := readEphemyralFile(dir)
+	require.NoError(t, err)
+	require.Equal(t, "go build ./...", ephemyral.command("build"))
+	require.NoError(t, mergeProjectConfig(dir))
+	require.Equal(t, "go build ./...", viper.GetString("commands.build.command"))
+	require.False(t, viper.IsSet("build-command"))
+	data, err := os.ReadFile(filepath.Join(dir, ".ephemyral"))
+	require.NoError(t, err)
+	require.Equal(t, original, string(data))
+
+	require.NoError(t, updateEphemyralFile(dir, "test", GeneratedCommand{Command: "go test ./...", WorkingDir: "."}))
+	ephemyral, err = readEphemyralFile(dir)
+	require.NoError(t, err)
+	require.Equal(t, currentConfigVersion, ephemyral.Version)
+	require.Equal(t, "go build ./...", ephemyral.command("build"))
+	require.Equal(t, "go test ./...", ephemyral.command("test"))
+	backup, err := os.ReadFile(filepath.Join(dir, ".ephemyral.v1.bak"))
+	require.NoError(t, err)
+	require.Equal(t, original, string(backup))
+}
+
+func TestMigrateKeepsCommentsAndBackup(t *testing.T) {
+	dir := t.TempDir()
+	original := "# project settings\nbuild-command: go build ./... # fast\ntest-command: \"\"\ncommands:\n  lint:\n    command: go vet ./...\nrationales:\n  build: the module has no main package\n  test: gone\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte(original), 0644))
+
+	applied, backup, err := migrateEphemyralFile(dir)
+	require.NoError(t, err)
+	require.Len(t, applied, 1)
+
+	data, err := os.ReadFile(filepath.Join(dir, ".ephemyral"))
+	require.NoError(t, err)
+	require.Equal(t, "# project settings\nversion: 2\ncommands:\n  lint:\n    command: go vet ./...\n  build:\n    command: go build ./... # fast\n    rationale: the module has no main package\n", string(data))
+	saved, err := os.ReadFile(backup)
+	require.NoError(t, err)
+	require.Equal(t, original, string(saved))
+
+	applied, _, err = migrateEphemyralFile(dir)
+	require.NoError(t, err)
+	require.Empty(t, applied)
+}
+
+func TestReadEphemyralFileRejectsUnknownKeys(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("version: 2\ncommands:\n  test:\n    comand: go test\n"), 0644))
+
+	_, err := readEphemyralFile(dir)
+	require.ErrorContains(t, err, `.ephemyral:4: unknown key "comand"`)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("version: 3\n"), 0644))
+	_, err = readEphemyralFile(dir)
+	require.ErrorContains(t, err, "newer")
+}
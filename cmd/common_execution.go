@@ -4,9 +4,14 @@
 package cmd
 
 import (
+	"context"
+	gpt4client "ephemyral/pkg"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -17,13 +22,37 @@ const (
 	BashOpt = "-c"
 )
 
-func runCommand(cmdType, filePath string, convID uuid.UUID, retryCount int, retryDelay time.Duration) bool {
+// commandWaitDelay is how long to wait for the output of a killed command to
+// be closed, in case a process outside its group still holds it.
+const commandWaitDelay = 5 * time.Second
+
+func runCommand(ctx context.Context, cmdType, filePath string, convID uuid.UUID, retryCount int, retryDelay time.Duration) bool {
 	directory, err := findEphemyralDirectory(filePath)
 	if err != nil {
 		return logError("Error:", err)
 	}
 
-	return executeCommandOrLog(directory, cmdType, convID, retryCount, retryDelay)
+	return executeCommandOrLog(ctx, directory, cmdType, convID, retryCount, retryDelay)
+}
+
+// runRequestedCommands runs the enabled command types in order and returns the
+// first one that failed, or "" when all of them succeeded.
+func runRequestedCommands(ctx context.Context, filePath string, convID uuid.UUID, retryCount int, retryDelay time.Duration, runBuild, runLint, runTest, runDocs bool) string {
+	requested := []struct {
+		enabled bool
+		cmdType string
+	}{
+		{runBuild, "build"},
+		{runLint, "lint"},
+		{runTest, "test"},
+		{runDocs, "docs"},
+	}
+	for _, r := range requested {
+		if r.enabled && !runCommand(ctx, r.cmdType, filePath, convID, retryCount, retryDelay) {
+			return r.cmdType
+		}
+	}
+	return ""
 }
 
 func logError(msg string, err error) bool {
@@ -31,34 +60,65 @@ func logError(msg string, err error) bool {
 	return false
 }
 
-func executeCommandOrLog(directory, cmdType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) bool {
+func executeCommandOrLog(ctx context.Context, directory, cmdType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) bool {
 	cmd, err := getExistingCommandOrError(directory, cmdType)
 	if err != nil || cmd == "" {
 		return logError("Error reading existing "+cmdType+" command:", err)
 	}
 
-	return logExecutionResult(directory, cmd, cmdType, convID, retryCount, retryDelay)
+	return logExecutionResult(ctx, directory, cmd, cmdType, convID, retryCount, retryDelay)
 }
 
-func logExecutionResult(directory, cmd, cmdType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) bool {
-	if err := executeWithRetries(directory, cmd, cmdType, convID, retryCount, retryDelay); err != nil {
+func logExecutionResult(ctx context.Context, directory, cmd, cmdType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) bool {
+	_, err := executeWithRetries(ctx, directory, cmd, cmdType, storedOrigin(cmdType), convID, retryCount, retryDelay)
+	if errors.Is(err, errDryRun) {
+		fmt.Println(err)
+		return true
+	}
+	if err != nil {
 		return logError("Failed to execute "+cmdType+" command:", err)
 	}
 	fmt.Println(cmdType, "command executed successfully.")
 	return true
 }
 
-func executeCommand(directory, command string) error {
-	cmd := createCommand(directory, command)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+func executeCommand(ctx context.Context, directory, command string) error {
+	_, err := executeCommandWithOutput(ctx, directory, command, execOptions{env: commandEnv(EphemyralFile{}, "")})
+	return err
+}
+
+// executeCommandWithOutput runs command with opts and its output going to the
+// terminal, and returns the tail of that output as well.
+func executeCommandWithOutput(ctx context.Context, directory, command string, opts execOptions) (commandOutput, error) {
+	stdout, stderr := newRingBuffer(outputTailSize), newRingBuffer(outputTailSize)
+	killed, err := runCommandWithOptions(ctx, directory, command, opts, io.MultiWriter(os.Stdout, stdout), io.MultiWriter(os.Stderr, stderr))
+	return commandOutput{Stdout: stdout.String(), Stderr: stderr.String(), ExitCode: exitCode(err), Killed: killed}, err
+}
+
+// createCommand returns the shell process for command, seeing only the
+// environment in opts and run by the executor in opts. The memory and CPU
+// limits are applied by the shell; the process group is killed when ctx ends.
+func createCommand(ctx context.Context, directory, command string, opts execOptions) (*exec.Cmd, error) {
+	script := rlimitPrefix(opts.limits) + command
+	var cmd *exec.Cmd
+	if opts.sandbox != nil {
+		var err error
+		if cmd, err = sandboxCommand(ctx, directory, script, opts); err != nil {
+			return nil, err
+		}
+	} else {
+		cmd = exec.CommandContext(ctx, opts.shellCmd(), BashOpt, script)
+	}
+	cmd.Dir = opts.dir(directory)
+	cmd.Env = opts.env
+	cmd.WaitDelay = commandWaitDelay
+	configureProcessGroup(cmd)
+	return cmd, nil
 }
 
-func createCommand(directory, command string) *exec.Cmd {
-	cmd := exec.Command(BashCmd, BashOpt, command)
-	cmd.Dir = directory
-	return cmd
+// storedOrigin describes a command read from the .ephemyral file.
+func storedOrigin(commandType string) string {
+	return fmt.Sprintf("%s-command in .ephemyral", commandType)
 }
 
 func getExistingCommandOrError(directory, commandType string) (string, error) {
@@ -73,76 +133,174 @@ func wrapError(err error, msg string) error {
 	return nil
 }
 
-func executeCommandOfType(directory, commandType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) error {
-	cmd, err := getExistingCommandOrError(directory, commandType)
+// executeCommandOfType runs the commands that commandType depends on and then
+// commandType itself, generating those that are not stored yet.
+func executeCommandOfType(ctx context.Context, directory, commandType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) error {
+	return executeWithDependencies(ctx, directory, commandType, convID, retryCount, retryDelay, nil, map[string]bool{})
+}
+
+// executeWithDependencies runs commandType after its depends-on commands,
+// with the retry count of its entry when it has one. waiting holds the
+// commands that depend on commandType, to detect cycles; done holds those
+// that already succeeded in this run.
+func executeWithDependencies(ctx context.Context, directory, commandType string, convID uuid.UUID, retryCount int, retryDelay time.Duration, waiting []string, done map[string]bool) error {
+	if done[commandType] {
+		return nil
+	}
+	if containsString(waiting, commandType) {
+		return fmt.Errorf("dependency cycle: %s", strings.Join(append(waiting, commandType), " -> "))
+	}
+	ephemyral, err := readEphemyralFile(directory)
 	if err != nil {
+		return wrapError(err, "reading the "+commandType+" command")
+	}
+
+	settings := ephemyral.Commands[commandType]
+	waiting = append(waiting[:len(waiting):len(waiting)], commandType)
+	for _, dependency := range settings.DependsOn {
+		err := executeWithDependencies(ctx, directory, dependency, convID, retryCount, retryDelay, waiting, done)
+		if err != nil && !errors.Is(err, errDryRun) {
+			return fmt.Errorf("%s depends on %s: %w", commandType, dependency, err)
+		}
+	}
+	if err := executeStoredCommand(ctx, directory, commandType, convID, retryCount, retryDelay); err != nil {
 		return err
 	}
+	done[commandType] = true
+	return nil
+}
 
-	return executeOrGenerateCommand(directory, cmd, commandType, convID, retryCount, retryDelay)
+// executeStoredCommand runs commandType alone, with the retry count of its
+// entry when it has one, generating it when it is not stored yet. Its
+// working-dir, env and timeout are applied by execOptionsFor.
+func executeStoredCommand(ctx context.Context, directory, commandType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) error {
+	ephemyral, err := readEphemyralFile(directory)
+	if err != nil {
+		return wrapError(err, "reading the "+commandType+" command")
+	}
+	settings := ephemyral.Commands[commandType]
+	if settings.Retry < 0 {
+		return fmt.Errorf("invalid retry %d of the %s command", settings.Retry, commandType)
+	}
+	if settings.Retry > 0 {
+		retryCount = settings.Retry
+	}
+
+	cmd, err := getExistingCommandOrError(directory, commandType)
+	if err != nil {
+		return err
+	}
+	return executeOrGenerateCommand(ctx, directory, cmd, commandType, convID, retryCount, retryDelay)
 }
 
-func executeOrGenerateCommand(directory, cmd, cmdType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) error {
+func executeOrGenerateCommand(ctx context.Context, directory, cmd, cmdType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) error {
 	if cmd != "" {
-		return executeWithRetryHandling(directory, cmd, cmdType, convID, retryCount, retryDelay)
+		return executeWithRetryHandling(ctx, directory, cmd, cmdType, convID, retryCount, retryDelay)
 	}
 
-	return generateAndExecuteCommand(directory, cmdType, convID, retryCount, retryDelay)
+	return generateAndExecuteCommand(ctx, directory, cmdType, convID, retryCount, retryDelay)
 }
 
-func executeWithRetryHandling(directory, cmd, cmdType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) error {
-	if err := executeWithRetries(directory, cmd, cmdType, convID, retryCount, retryDelay); err != nil {
+func executeWithRetryHandling(ctx context.Context, directory, cmd, cmdType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) error {
+	if _, err := executeWithRetries(ctx, directory, cmd, cmdType, storedOrigin(cmdType), convID, retryCount, retryDelay); err != nil {
+		if isNotExecuted(err) {
+			return err
+		}
 		return fmt.Errorf("failed to execute %s command after retries: %v", cmdType, err)
 	}
 	return nil
 }
 
-func executeWithRetries(directory, command, commandType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) error {
+// executeWithRetries runs command until it exits with status zero, at most
+// retryCount times, trying suggested dependency installations in between.
+// The returned result holds every attempt; the error is nil only on success.
+func executeWithRetries(ctx context.Context, directory, command, commandType, origin string, convID uuid.UUID, retryCount int, retryDelay time.Duration) (*ExecutionResult, error) {
+	opts, err := execOptionsFor(directory, commandType)
+	if err != nil {
+		return nil, err
+	}
+	return executeWithOptions(ctx, directory, opts, command, commandType, origin, convID, retryCount, retryDelay)
+}
+
+// executeWithOptions is executeWithRetries with the given execution options
+// instead of those configured for commandType.
+func executeWithOptions(ctx context.Context, directory string, opts execOptions, command, commandType, origin string, convID uuid.UUID, retryCount int, retryDelay time.Duration) (*ExecutionResult, error) {
+	showEnv(os.Stdout, commandType, opts.env)
+	result := &ExecutionResult{CommandType: commandType, opts: opts}
+	defer result.Print(os.Stdout)
+
 	for i := 0; i < retryCount; i++ {
-		if err := tryExecuteCommand(directory, command, commandType, convID, retryDelay); err == nil {
-			return nil
+		err := tryExecuteCommand(ctx, directory, command, commandType, origin, convID, retryDelay, result)
+		if err == nil && result.Succeeded() {
+			return result, nil
+		}
+		if isNotExecuted(err) {
+			return result, err
+		}
+		if ctx.Err() != nil {
+			return result, ctx.Err()
 		}
 	}
-	return fmt.Errorf("failed to execute %s command after retries", commandType)
+	return result, fmt.Errorf("failed to execute %s command after retries", commandType)
 }
 
-func tryExecuteCommand(directory, command, commandType string, convID uuid.UUID, retryDelay time.Duration) error {
+func tryExecuteCommand(ctx context.Context, directory, command, commandType, origin string, convID uuid.UUID, retryDelay time.Duration, result *ExecutionResult) error {
+	if err := authorizeCommand(directory, result.opts.dir(directory), command, origin); err != nil {
+		return err
+	}
 	fmt.Printf("Running %s command: %s\n", commandType, command)
-	if err := executeCommand(directory, command); err != nil {
-		return handleExecutionError(directory, command, commandType, convID, err, retryDelay)
+	if attempt := result.run(ctx, directory, command, false); !attempt.Succeeded() {
+		return handleExecutionError(ctx, directory, command, commandType, convID, attempt, retryDelay, result)
 	}
 	fmt.Printf("Successfully executed %s command: %s\n", commandType, command)
 	return nil
 }
 
-func handleExecutionError(directory, command, commandType string, convID uuid.UUID, err error, retryDelay time.Duration) error {
-	fmt.Println("Error executing command:", err)
-	dependencyCommand, depErr := generateDependencyCommand(command, err.Error(), convID)
+func handleExecutionError(ctx context.Context, directory, command, commandType string, convID uuid.UUID, failed Attempt, retryDelay time.Duration, result *ExecutionResult) error {
+	fmt.Println("Error executing command:", failed.Err)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if failed.Output.Killed != "" {
+		// Installing dependencies does not help a command that hit a limit.
+		return fmt.Errorf("%s command %v", commandType, failed.Err)
+	}
+	dependencyCommand, depErr := generateDependencyCommand(ctx, directory, command, failed.Output, convID)
+	if errors.Is(depErr, errNoDependencyFix) {
+		return fmt.Errorf("%s command failed with exit code %d: %v", commandType, failed.ExitCode, depErr)
+	}
 	if depErr != nil {
 		return fmt.Errorf("error generating dependency command: %v", depErr)
 	}
 
-	return tryDependencyCommand(directory, command, commandType, dependencyCommand, retryDelay)
+	return tryDependencyCommand(ctx, directory, command, commandType, dependencyCommand, convID, retryDelay, result)
 }
 
-func tryDependencyCommand(directory, command, commandType, dependencyCommand string, retryDelay time.Duration) error {
+func tryDependencyCommand(ctx context.Context, directory, command, commandType, dependencyCommand string, convID uuid.UUID, retryDelay time.Duration, result *ExecutionResult) error {
+	origin := fmt.Sprintf("dependency installation suggested by the LLM after the %s command failed", commandType)
+	if err := authorizeCommand(directory, result.opts.dir(directory), dependencyCommand, origin); err != nil {
+		return err
+	}
 	fmt.Printf("Running dependency installation command: %s\n", dependencyCommand)
-	if depErr := executeCommand(directory, dependencyCommand); depErr != nil {
-		fmt.Println("Error executing dependency command:", depErr)
-		time.Sleep(retryDelay)
-	} else {
-		return reattemptOriginalCommand(directory, command, commandType, retryDelay)
+	if attempt := result.run(ctx, directory, dependencyCommand, true); !attempt.Succeeded() {
+		fmt.Println("Error executing dependency command:", attempt.Err)
+		gpt4client.RecordFeedback(convID, fmt.Sprintf("The dependency command `%s` failed with exit code %d:\n%s", strings.TrimSpace(dependencyCommand), attempt.ExitCode, attempt.Output))
+		if err := sleepContext(ctx, retryDelay); err != nil {
+			return err
+		}
+		return fmt.Errorf("dependency command failed with exit code %d", attempt.ExitCode)
 	}
-	return nil
+	return reattemptOriginalCommand(ctx, directory, command, commandType, retryDelay, result)
 }
 
-func reattemptOriginalCommand(directory, command, commandType string, retryDelay time.Duration) error {
-	if err := executeCommand(directory, command); err != nil {
-		fmt.Println("Error executing command:", err)
-		time.Sleep(retryDelay)
-	} else {
-		fmt.Printf("Successfully executed %s command after dependency installation: %s\n", commandType, command)
-		return nil
+func reattemptOriginalCommand(ctx context.Context, directory, command, commandType string, retryDelay time.Duration, result *ExecutionResult) error {
+	if attempt := result.run(ctx, directory, command, false); !attempt.Succeeded() {
+		fmt.Println("Error executing command:", attempt.Err)
+		if err := sleepContext(ctx, retryDelay); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s command still fails after dependency installation, exit code %d", commandType, attempt.ExitCode)
 	}
+	fmt.Printf("Successfully executed %s command after dependency installation: %s\n", commandType, command)
 	return nil
 }
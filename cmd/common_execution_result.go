@@ -0,0 +1,100 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Attempt is one run of a command, or of a dependency installation command
+// suggested after it failed.
+type Attempt struct {
+	Command    string
+	Dependency bool
+	ExitCode   int
+	Duration   time.Duration
+	Output     commandOutput
+	Err        error
+}
+
+// Succeeded reports whether the run exited with status zero.
+func (a Attempt) Succeeded() bool {
+	return a.Err == nil && a.ExitCode == 0
+}
+
+// Status is "ok", "failed" or, for commands that hit a limit, "killed: "
+// followed by the limit.
+func (a Attempt) Status() string {
+	switch {
+	case a.Output.Killed != "":
+		return "killed: " + a.Output.Killed
+	case a.Succeeded():
+		return "ok"
+	default:
+		return "failed"
+	}
+}
+
+// ExecutionResult records every attempt made to run a command of one type.
+type ExecutionResult struct {
+	CommandType string
+	Attempts    []Attempt
+	opts        execOptions
+}
+
+// run executes command in directory and records the attempt.
+func (r *ExecutionResult) run(ctx context.Context, directory, command string, dependency bool) Attempt {
+	start := time.Now()
+	output, err := executeCommandWithOutput(ctx, directory, command, r.opts)
+	attempt := Attempt{
+		Command:    command,
+		Dependency: dependency,
+		ExitCode:   output.ExitCode,
+		Duration:   time.Since(start),
+		Output:     output,
+		Err:        err,
+	}
+	r.Attempts = append(r.Attempts, attempt)
+	return attempt
+}
+
+// Succeeded reports whether the last run of the command itself exited with
+// status zero.
+func (r *ExecutionResult) Succeeded() bool {
+	last, ok := r.lastRun()
+	return ok && last.Succeeded()
+}
+
+// lastRun returns the last attempt that ran the command itself.
+func (r *ExecutionResult) lastRun() (Attempt, bool) {
+	for i := len(r.Attempts) - 1; i >= 0; i-- {
+		if !r.Attempts[i].Dependency {
+			return r.Attempts[i], true
+		}
+	}
+	return Attempt{}, false
+}
+
+// Print writes the attempt history as a table.
+func (r *ExecutionResult) Print(out io.Writer) {
+	if len(r.Attempts) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "%s attempts:\n", r.CommandType)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tKIND\tSTATUS\tEXIT\tDURATION\tCOMMAND")
+	for i, a := range r.Attempts {
+		kind := "command"
+		if a.Dependency {
+			kind = "dependency"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\n", i+1, kind, a.Status(), a.ExitCode, a.Duration.Round(time.Millisecond), strings.TrimSpace(a.Command))
+	}
+	w.Flush()
+}
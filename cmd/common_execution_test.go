@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"ephemyral/pkg/llmtest"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecuteCommandCancelKillsProcessGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := executeCommand(ctx, t.TempDir(), "sleep 30 & sleep 30; wait")
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestRepairPromptIncludesCommandOutput(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Reply("NONE"))
+	defer server.Close()
+	configureTestLLM(t, server)
+
+	_, err := executeWithRetries(context.Background(), t.TempDir(), "echo compiling; echo 'main.go:3: undefined: foo' >&2; exit 2", "build", "stored", uuid.New(), 1, 0)
+	require.Error(t, err)
+
+	requests := server.Requests()
+	require.Len(t, requests, 1)
+	prompt := requests[0].Prompt()
+	require.Contains(t, prompt, "Exit code: 2")
+	require.Contains(t, prompt, "stdout:\ncompiling")
+	require.Contains(t, prompt, "stderr:\nmain.go:3: undefined: foo")
+	require.Contains(t, prompt, "OS: "+runtime.GOOS)
+}
+
+func TestFailedReattemptIsNotSuccess(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Reply("true"))
+	defer server.Close()
+	configureTestLLM(t, server)
+
+	result, err := executeWithRetries(context.Background(), t.TempDir(), "exit 3", "build", "stored", uuid.New(), 1, 0)
+	require.Error(t, err)
+	require.False(t, result.Succeeded())
+
+	require.Len(t, result.Attempts, 3)
+	require.Equal(t, []bool{false, true, false}, []bool{result.Attempts[0].Dependency, result.Attempts[1].Dependency, result.Attempts[2].Dependency})
+	require.Equal(t, 3, result.Attempts[0].ExitCode)
+	require.Equal(t, 0, result.Attempts[1].ExitCode)
+	require.Equal(t, 3, result.Attempts[2].ExitCode)
+}
+
+func TestSuccessfulRunRecordsSingleAttempt(t *testing.T) {
+	result, err := executeWithRetries(context.Background(), t.TempDir(), "echo ok", "test", "stored", uuid.New(), 3, 0)
+	require.NoError(t, err)
+	require.True(t, result.Succeeded())
+	require.Len(t, result.Attempts, 1)
+	require.Equal(t, "ok\n", result.Attempts[0].Output.Stdout)
+}
+
+func TestCommandSettingsAreHonoured(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Reply("NONE"))
+	defer server.Close()
+	configureTestLLM(t, server)
+
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte(`commands:
+  prepare:
+    command: echo "$GREETING" > ../greeting
+    working-dir: sub
+    env:
+      GREETING: hello
+  test:
+    command: test "$(cat greeting)" = hello && echo $0 > shell
+    shell: sh
+    depends-on: [prepare]
+  slow:
+    command: sleep 30
+    timeout: 100ms
+    retry: 1
+`), 0644))
+
+	require.NoError(t, executeCommandOfType(context.Background(), dir, "test", uuid.New(), 3, 0))
+	shell, err := os.ReadFile(filepath.Join(dir, "shell"))
+	require.NoError(t, err)
+	require.Equal(t, "sh\n", string(shell))
+
+	start := time.Now()
+	require.Error(t, executeCommandOfType(context.Background(), dir, "slow", uuid.New(), 3, 0))
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Empty(t, server.Requests())
+}
+
+func TestDependencyCycleIsRejected(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("commands:\n  a:\n    command: 'true'\n    depends-on: [b]\n  b:\n    command: 'true'\n    depends-on: [a]\n"), 0644))
+
+	err := executeCommandOfType(context.Background(), dir, "a", uuid.New(), 1, 0)
+	require.ErrorContains(t, err, "dependency cycle: a -> b -> a")
+}
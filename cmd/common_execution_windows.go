@@ -0,0 +1,10 @@
+//go:build !lint && windows
+// +build !lint,windows
+
+package cmd
+
+import "os/exec"
+
+// configureProcessGroup is a no-op on Windows, where exec.CommandContext
+// already kills the process on cancellation.
+func configureProcessGroup(cmd *exec.Cmd) {}
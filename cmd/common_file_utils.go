@@ -95,3 +95,39 @@ func shouldSkipDir(info os.FileInfo) bool {
 func getRelativePath(base, target string) (string, error) {
 	return filepath.Rel(base, target)
 }
+
+// writeFileAtomic writes data to a temporary file next to filename and renames
+// it into place, so an interrupted write never leaves a half-written file.
+// Symlinks are followed, an existing file keeps its mode and perm is the mode
+// of a new one. A file with other hard links is written in place, since the
+// rename would detach it from them.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	if target, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = target
+	}
+	if info, err := os.Stat(filename); err == nil {
+		perm = info.Mode().Perm()
+		if hasOtherLinks(info) {
+			return os.WriteFile(filename, data, perm)
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filename)
+}
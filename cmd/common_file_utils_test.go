@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteFileAtomicKeepsModeAndLinks(t *testing.T) {
+	dir := t.TempDir()
+	script := filepath.Join(dir, "build.sh")
+	require.NoError(t, os.WriteFile(script, []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, os.Chmod(script, 0755))
+
+	require.NoError(t, writeFileAtomic(script, []byte("#!/bin/sh\nmake\n"), 0644))
+	info, err := os.Stat(script)
+	require.NoError(t, err)
+	if runtime.GOOS != "windows" {
+		require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	}
+
+	link := filepath.Join(dir, "link.sh")
+	require.NoError(t, os.Symlink(script, link))
+	require.NoError(t, writeFileAtomic(link, []byte("symlinked\n"), 0644))
+	info, err = os.Lstat(link)
+	require.NoError(t, err)
+	require.NotZero(t, info.Mode()&os.ModeSymlink)
+	content, err := os.ReadFile(script)
+	require.NoError(t, err)
+	require.Equal(t, "symlinked\n", string(content))
+
+	if runtime.GOOS == "windows" {
+		return
+	}
+	hardlink := filepath.Join(dir, "hardlink.sh")
+	require.NoError(t, os.Link(script, hardlink))
+	require.NoError(t, writeFileAtomic(hardlink, []byte("hardlinked\n"), 0644))
+	content, err = os.ReadFile(script)
+	require.NoError(t, err)
+	require.Equal(t, "hardlinked\n", string(content))
+}
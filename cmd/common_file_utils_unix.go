@@ -0,0 +1,15 @@
+//go:build !lint && !windows
+// +build !lint,!windows
+
+package cmd
+
+import (
+	"os"
+	"syscall"
+)
+
+// hasOtherLinks reports whether the file has more than one hard link.
+func hasOtherLinks(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Nlink > 1
+}
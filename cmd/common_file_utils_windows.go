@@ -0,0 +1,10 @@
+//go:build !lint && windows
+// +build !lint,windows
+
+package cmd
+
+import "os"
+
+// hasOtherLinks reports false on Windows, where the link count is not part of
+// the file info.
+func hasOtherLinks(info os.FileInfo) bool { return false }
@@ -0,0 +1,160 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	gpt4client "ephemyral/pkg"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// maxSchemaRetries is how often the model is asked again after a reply that
+// does not match the command schema.
+const maxSchemaRetries = 2
+
+// GeneratedCommand is the structured reply to a command generation prompt.
+type GeneratedCommand struct {
+	Command       string   `json:"command"`
+	WorkingDir    string   `json:"working_dir"`
+	Prerequisites []string `json:"prerequisites"`
+	Rationale     string   `json:"rationale"`
+}
+
+// generatedCommandSchema is the JSON schema GeneratedCommand is requested in.
+var generatedCommandSchema = &gpt4client.Schema{
+	Name: "generated_command",
+	Definition: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"command":       map[string]interface{}{"type": "string", "description": "A single shell command line"},
+			"working_dir":   map[string]interface{}{"type": "string", "description": "Directory to run the command in, relative to the project root"},
+			"prerequisites": map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}, "description": "Programs that must be installed"},
+			"rationale":     map[string]interface{}{"type": "string", "description": "Why this command was chosen"},
+		},
+		"required":             []string{"command", "working_dir", "prerequisites", "rationale"},
+		"additionalProperties": false,
+	},
+}
+
+// requestGeneratedCommand sends prompt and parses the reply as a
+// GeneratedCommand for directory, asking the model again when the reply does
+// not match the schema or the command breaks the shell policy.
+func requestGeneratedCommand(ctx context.Context, operation, prompt, directory string, convID uuid.UUID) (GeneratedCommand, error) {
+	for attempt := 0; ; attempt++ {
+		reply, err := gpt4client.GetStructuredResponse(ctx, operation, prompt, convID, generatedCommandSchema)
+		if err != nil {
+			return GeneratedCommand{}, err
+		}
+
+		generated, err := parseGeneratedCommand(reply, directory)
+		retryPrompt := SchemaViolationPrompt
+		if err == nil {
+			if err = checkShellPolicyIn(directory, filepath.Join(directory, generated.WorkingDir), generated.Command); err == nil {
+				return generated, nil
+			}
+			retryPrompt = ShellPolicyPrompt
+		}
+		if attempt >= maxSchemaRetries {
+			return GeneratedCommand{}, fmt.Errorf("invalid %s command from LLM: %w", operation, err)
+		}
+		fmt.Printf("Invalid %s command from LLM (%v), asking again\n", operation, err)
+		prompt = fmt.Sprintf(retryPrompt, err)
+	}
+}
+
+// parseGeneratedCommand decodes and validates a reply. Code fences around the
+// JSON are tolerated; unknown fields are not.
+func parseGeneratedCommand(reply, directory string) (GeneratedCommand, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(strings.TrimSpace(filterOutCodeBlocks(reply)))))
+	decoder.DisallowUnknownFields()
+
+	var generated GeneratedCommand
+	if err := decoder.Decode(&generated); err != nil {
+		return GeneratedCommand{}, fmt.Errorf("reply is not the requested JSON object: %v", err)
+	}
+	if decoder.More() {
+		return GeneratedCommand{}, errors.New("reply contains more than one JSON value")
+	}
+	if err := generated.validate(directory); err != nil {
+		return GeneratedCommand{}, err
+	}
+	return generated, nil
+}
+
+// validate checks the fields that the schema alone cannot.
+func (g *GeneratedCommand) validate(directory string) error {
+	g.Command = strings.TrimSpace(g.Command)
+	if g.Command == "" {
+		return errors.New(`"command" is empty`)
+	}
+	if strings.ContainsAny(g.Command, "\r\n") {
+		return errors.New(`"command" must be a single line`)
+	}
+	if strings.Contains(g.Command, "```") {
+		return errors.New(`"command" must not contain code fences`)
+	}
+
+	g.WorkingDir = filepath.Clean(firstNonEmpty(strings.TrimSpace(g.WorkingDir), "."))
+	if !filepath.IsLocal(g.WorkingDir) {
+		return fmt.Errorf(`"working_dir" %q must be a relative path inside the project`, g.WorkingDir)
+	}
+	if info, err := os.Stat(filepath.Join(directory, g.WorkingDir)); err != nil || !info.IsDir() {
+		return fmt.Errorf(`"working_dir" %q is not a directory of the project`, g.WorkingDir)
+	}
+
+	for _, p := range g.Prerequisites {
+		if strings.TrimSpace(p) == "" {
+			return errors.New(`"prerequisites" contains an empty entry`)
+		}
+	}
+	return nil
+}
+
+// store copies the structured fields into the commands entry. A working
+// directory of "." keeps the one configured for the entry.
+func (g GeneratedCommand) store(entry *CommandSettings) {
+	entry.Command = g.Command
+	if g.WorkingDir != "." && g.WorkingDir != "" {
+		entry.WorkingDir = filepath.ToSlash(g.WorkingDir)
+	}
+	entry.Prerequisites = g.Prerequisites
+	entry.Rationale = g.Rationale
+}
+
+// missingPrerequisites returns the prerequisites that are not found in PATH.
+func (g GeneratedCommand) missingPrerequisites() []string {
+	var missing []string
+	for _, p := range g.Prerequisites {
+		if _, err := exec.LookPath(strings.Fields(p)[0]); err != nil {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// shellQuote quotes s for POSIX shells when it contains special characters.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGeneratedCommand(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "web app"), 0755))
+
+	generated, err := parseGeneratedCommand("```json\n{\"command\": \"npm run build\", \"working_dir\": \"web app\", \"prerequisites\": [\"npm\"], \"rationale\": \"uses the build script\"}\n```", dir)
+	require.NoError(t, err)
+	require.Equal(t, "npm run build", generated.Command)
+	require.Equal(t, "web app", generated.WorkingDir)
+	require.Equal(t, "uses the build script", generated.Rationale)
+
+	invalid := []string{
+		"npm run build",
+		`{"command": "", "working_dir": ".", "prerequisites": [], "rationale": ""}`,
+		`{"command": "make\nmake install", "working_dir": ".", "prerequisites": [], "rationale": ""}`,
+		`{"command": "make", "working_dir": "../other", "prerequisites": [], "rationale": ""}`,
+		`{"command": "make", "working_dir": "missing", "prerequisites": [], "rationale": ""}`,
+		`{"command": "make", "working_dir": ".", "prerequisites": [], "rationale": "", "explanation": "extra"}`,
+	}
+	for _, reply := range invalid {
+		_, err := parseGeneratedCommand(reply, dir)
+		require.Error(t, err, reply)
+	}
+}
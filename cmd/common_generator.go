@@ -4,9 +4,10 @@
 package cmd
 
 import (
+	"context"
 	gpt4client "ephemyral/pkg"
+	"errors"
 	"fmt"
-	"runtime"
 	"strings"
 	"time"
 
@@ -15,43 +16,107 @@ import (
 
 var retryDelay = 2 * time.Second
 
-// Function type for generating commands.
-type commandGenerator func(directory string, convID uuid.UUID) (string, error)
+// builtinCommandPrompts describes the built-in command types to the LLM.
+var builtinCommandPrompts = map[string]string{
+	"test":  TestCommandPrompt,
+	"lint":  LintCommandPrompt,
+	"build": BuildCommandPrompt,
+	"docs":  DocsCommandPrompt,
+}
 
-// Map associating command types with their respective generation functions.
-var commandGenerators = map[string]commandGenerator{
-	"test":  generateTestCommand,
-	"lint":  generateLintCommand,
-	"build": generateBuildCommand,
-	"docs":  generateDocsCommand,
+// commandPrompt describes the command called name to the LLM, using the
+// prompt of its commands entry when there is one.
+func commandPrompt(directory, name string) (string, error) {
+	ephemyral, err := readEphemyralFile(directory)
+	if err != nil {
+		return "", err
+	}
+	if prompt := strings.TrimSpace(ephemyral.Commands[name].Prompt); prompt != "" {
+		return fmt.Sprintf(NamedCommandPrompt, prompt), nil
+	}
+	if prompt, ok := builtinCommandPrompts[name]; ok {
+		return prompt, nil
+	}
+	return fmt.Sprintf(DefaultNamedCommandPrompt, name), nil
 }
 
-// Generates and executes a new command of a given type
-func generateAndExecuteCommand(directory, commandType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) error {
-	generator, found := commandGenerators[commandType]
-	if !found {
-		return fmt.Errorf("generator function not found for command type: %s", commandType)
+// generateCommand asks the LLM for the command called name.
+func generateCommand(ctx context.Context, directory, name string, convID uuid.UUID) (GeneratedCommand, error) {
+	prompt, err := commandPrompt(directory, name)
+	if err != nil {
+		return GeneratedCommand{}, err
+	}
+	filesList, err := getFileList(directory)
+	if err != nil {
+		return GeneratedCommand{}, err
 	}
 
+	fullPrompt := prompt + CommandResponseFormat + fitFileList(name, filesList)
+	gpt4client.SetDebug(false)
+	generated, err := requestGeneratedCommand(ctx, name, fullPrompt, directory, convID)
+	if err != nil {
+		return GeneratedCommand{}, fmt.Errorf("error generating %s command: %w", name, err)
+	}
+	return generated, nil
+}
+
+// Generates and executes a new command of a given type
+func generateAndExecuteCommand(ctx context.Context, directory, commandType string, convID uuid.UUID, retryCount int, retryDelay time.Duration) error {
 	for i := 0; i < retryCount; i++ {
-		// Generate a new command using the appropriate generator function
-		command, err := generator(directory, convID)
+		generated, err := generateCommand(ctx, directory, commandType, convID)
 		if err != nil {
 			fmt.Println("Error generating command:", err)
-			time.Sleep(retryDelay)
+			if isFatalLLMError(err) {
+				return err
+			}
+			if err := sleepContext(ctx, retryDelay); err != nil {
+				return err
+			}
 			continue
 		}
 
-		refactoredCommand := filterOutCodeBlocks(command)
-		fmt.Printf("Successfully generated %s command: %s\n", commandType, refactoredCommand)
+		fmt.Printf("Successfully generated %s command: %s\n", commandType, generated.Command)
+		if generated.WorkingDir != "." {
+			fmt.Println("Working directory:", generated.WorkingDir)
+		}
+		if generated.Rationale != "" {
+			fmt.Println("Rationale:", generated.Rationale)
+		}
+		if missing := generated.missingPrerequisites(); len(missing) > 0 {
+			fmt.Printf("Warning: prerequisites not found in PATH: %s\n", strings.Join(missing, ", "))
+		}
 
 		// Execute the generated command with retries
-		if err := executeWithRetries(directory, refactoredCommand, commandType, convID, retryCount, retryDelay); err != nil {
+		origin := fmt.Sprintf("generated by the LLM as the %s command", commandType)
+		opts, err := execOptionsFor(directory, commandType)
+		if err != nil {
+			return err
+		}
+		if generated.WorkingDir != "." {
+			if opts.workingDir, err = commandWorkingDir(directory, generated.WorkingDir); err != nil {
+				return err
+			}
+		}
+		result, err := executeWithOptions(ctx, directory, opts, generated.Command, commandType, origin, convID, retryCount, retryDelay)
+		if err != nil {
 			fmt.Println(err)
-			time.Sleep(retryDelay)
+			if isNotExecuted(err) {
+				return err
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			feedback := fmt.Sprintf("The %s command `%s` did not succeed (%v).", commandType, strings.TrimSpace(generated.Command), err)
+			if last, ok := result.lastRun(); ok {
+				feedback += "\n" + last.Output.String()
+			}
+			gpt4client.RecordFeedback(convID, feedback+" Suggest a different command.")
+			if err := sleepContext(ctx, retryDelay); err != nil {
+				return err
+			}
 		} else {
 			// Update the .ephemyral file with the successful command
-			if err := updateEphemyralFile(directory, commandType, refactoredCommand); err != nil {
+			if err := updateEphemyralFile(directory, commandType, generated); err != nil {
 				fmt.Println("Error updating .ephemyral file:", err)
 				return err
 			}
@@ -61,20 +126,36 @@ func generateAndExecuteCommand(directory, commandType string, convID uuid.UUID,
 	return fmt.Errorf("failed to generate or execute %s command after retries", commandType)
 }
 
-func generateDependencyCommand(failedCommand, errorMessage string, convID uuid.UUID) (string, error) {
-	// Determine the operating system
-	osType := runtime.GOOS
+// errNoDependencyFix is returned when the model finds that a command did not
+// fail because of a missing dependency.
+var errNoDependencyFix = errors.New("the failure is not caused by a missing dependency")
 
-	// Construct a prompt to handle missing dependencies
-	prompt := fmt.Sprintf("The following command '%s' failed with the error '%s'. Based on this error and the current operating system '%s', provide the simplest single-line command to install all necessary dependencies. The response should contain no comments, explanations, or code blocks, and if multiple commands are needed, they should be separated by '&&'. Include necessary flags like '-y' for automatic confirmation:\n", failedCommand, errorMessage, osType)
-	dependencyCommand, err := gpt4client.GetGPT4ResponseWithPrompt(prompt, convID)
-	if err != nil {
-		return "", err
-	}
+// generateDependencyCommand asks for a command that installs what
+// failedCommand is missing, given its output and the environment. It asks
+// again while the suggestion breaks the shell policy.
+func generateDependencyCommand(ctx context.Context, directory, failedCommand string, output commandOutput, convID uuid.UUID) (string, error) {
+	prompt := fmt.Sprintf(DependencyCommandPrompt, strings.TrimSpace(failedCommand), output, environmentInfo(ctx, failedCommand))
+	for attempt := 0; ; attempt++ {
+		dependencyCommand, err := gpt4client.GetResponse(ctx, "dependency", prompt, convID)
+		if err != nil {
+			return "", err
+		}
 
-	if strings.TrimSpace(dependencyCommand) == "" {
-		return "", fmt.Errorf("received empty dependency command")
-	}
+		if strings.TrimSpace(dependencyCommand) == "" {
+			return "", fmt.Errorf("received empty dependency command")
+		}
+		if strings.TrimSpace(dependencyCommand) == "NONE" {
+			return "", errNoDependencyFix
+		}
 
-	return dependencyCommand, nil
+		err = checkShellPolicy(directory, dependencyCommand)
+		if err == nil {
+			return dependencyCommand, nil
+		}
+		if attempt >= maxSchemaRetries {
+			return "", err
+		}
+		fmt.Printf("Dependency command rejected (%v), asking again\n", err)
+		prompt = fmt.Sprintf(ShellPolicyPrompt, err)
+	}
 }
@@ -0,0 +1,187 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandLimitsSettings bounds the resources a command of one type may use.
+// Sizes are bytes with an optional K, M or G suffix (powers of 1024).
+// MaxMemory limits the heap and other private writable memory of each
+// process, not the address space it reserves.
+type CommandLimitsSettings struct {
+	Timeout        string `yaml:"timeout,omitempty"`
+	MaxMemory      string `yaml:"max-memory,omitempty"`
+	MaxCPUSeconds  int    `yaml:"max-cpu-seconds,omitempty"`
+	MaxOutputBytes string `yaml:"max-output-bytes,omitempty"`
+}
+
+// commandLimits are parsed CommandLimitsSettings; zero values mean no limit.
+type commandLimits struct {
+	Timeout        time.Duration
+	MaxMemory      int64
+	MaxCPUSeconds  int
+	MaxOutputBytes int64
+}
+
+// Reasons a command was killed, reported in the execution result.
+var (
+	errKilledTimeout     = errors.New("timeout")
+	errKilledOutputLimit = errors.New("output limit")
+)
+
+func (s CommandLimitsSettings) parse() (commandLimits, error) {
+	limits := commandLimits{MaxCPUSeconds: s.MaxCPUSeconds}
+	var err error
+	if s.Timeout != "" {
+		if limits.Timeout, err = time.ParseDuration(s.Timeout); err != nil {
+			return limits, fmt.Errorf("timeout: %v", err)
+		}
+	}
+	if limits.MaxMemory, err = parseByteSize(s.MaxMemory); err != nil {
+		return limits, fmt.Errorf("max-memory: %v", err)
+	}
+	if limits.MaxOutputBytes, err = parseByteSize(s.MaxOutputBytes); err != nil {
+		return limits, fmt.Errorf("max-output-bytes: %v", err)
+	}
+	if limits.Timeout < 0 || limits.MaxCPUSeconds < 0 {
+		return limits, errors.New("limits must not be negative")
+	}
+	return limits, nil
+}
+
+// parseByteSize parses sizes like 512M, 2GiB or 1048576.
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	number := strings.TrimRight(s, "BbIiKkMmGgTt")
+	multiplier := int64(1)
+	switch strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(s[len(number):], "B"), "b")) {
+	case "":
+	case "K", "KI":
+		multiplier = 1 << 10
+	case "M", "MI":
+		multiplier = 1 << 20
+	case "G", "GI":
+		multiplier = 1 << 30
+	case "T", "TI":
+		multiplier = 1 << 40
+	default:
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// runCommandWithOptions runs command in directory with its output going to
+// stdout and stderr. The process group is killed when the timeout expires or
+// the output exceeds its limit; killed then tells which limit was hit.
+func runCommandWithOptions(ctx context.Context, directory, command string, opts execOptions, stdout, stderr io.Writer) (killed string, err error) {
+	limits := opts.limits
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if limits.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		runCtx, cancelTimeout = context.WithTimeoutCause(runCtx, limits.Timeout, errKilledTimeout)
+		defer cancelTimeout()
+	}
+
+	if limits.MaxOutputBytes > 0 {
+		limiter := &outputLimiter{remaining: limits.MaxOutputBytes, exceeded: func() { cancel(errKilledOutputLimit) }}
+		limitedStdout := limiter.wrap(stdout)
+		if stderr == stdout {
+			stderr = limitedStdout
+		} else {
+			stderr = limiter.wrap(stderr)
+		}
+		stdout = limitedStdout
+	}
+
+	if opts.sandbox != nil {
+		tmpDir, err := os.MkdirTemp("", "ephemyral-sandbox-")
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(tmpDir)
+		sandbox := *opts.sandbox
+		sandbox.tmpDir = tmpDir
+		opts.sandbox = &sandbox
+		opts.env = withTmpDir(opts.env, tmpDir)
+	}
+
+	cmd, err := createCommand(runCtx, directory, command, opts)
+	if err != nil {
+		return "", err
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err = cmd.Run()
+
+	if ctx.Err() == nil {
+		if cause := context.Cause(runCtx); errors.Is(cause, errKilledTimeout) || errors.Is(cause, errKilledOutputLimit) {
+			killed = cause.Error()
+		}
+	}
+	if killed == "" && err != nil {
+		killed = killedByResourceLimit(err, limits)
+	}
+	if killed != "" {
+		err = fmt.Errorf("killed: %s (%v)", killed, err)
+	}
+	return killed, err
+}
+
+// outputLimiter counts the output of a command across its streams and calls
+// exceeded once when the limit is passed. Output beyond the limit is dropped.
+type outputLimiter struct {
+	mu        sync.Mutex
+	remaining int64
+	exceeded  func()
+}
+
+type limitedWriter struct {
+	limiter *outputLimiter
+	w       io.Writer
+}
+
+func (l *outputLimiter) wrap(w io.Writer) io.Writer {
+	return &limitedWriter{limiter: l, w: w}
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	l := lw.limiter
+	l.mu.Lock()
+	keep := int64(len(p))
+	if keep > l.remaining {
+		keep = l.remaining
+	}
+	wasExceeded := l.remaining < 0
+	l.remaining -= int64(len(p))
+	nowExceeded := l.remaining < 0
+	l.mu.Unlock()
+
+	if keep > 0 {
+		if _, err := lw.w.Write(p[:keep]); err != nil {
+			return 0, err
+		}
+	}
+	if nowExceeded && !wasExceeded {
+		l.exceeded()
+	}
+	return len(p), nil
+}
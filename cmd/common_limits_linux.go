@@ -0,0 +1,67 @@
+//go:build !lint && linux
+// +build !lint,linux
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cpuAccountingSlack allows for the CPU time reported for a process killed at
+// its limit being slightly below the limit.
+const cpuAccountingSlack = 100 * time.Millisecond
+
+// rlimitPrefix returns shell lines that apply the memory and CPU limits to
+// the command that follows them. A limit that cannot be applied fails the
+// command with exit status 125 instead of running it unbounded.
+//
+// The memory limit is RLIMIT_DATA, which covers the heap and other private
+// writable memory of each process. Unlike the address space limit it leaves
+// the large reservations of runtimes such as Go, the JVM and node alone.
+func rlimitPrefix(limits commandLimits) string {
+	var prefix strings.Builder
+	if limits.MaxMemory > 0 {
+		fmt.Fprintf(&prefix, "ulimit -d %d || exit 125\n", (limits.MaxMemory+1023)/1024)
+	}
+	if limits.MaxCPUSeconds > 0 {
+		fmt.Fprintf(&prefix, "ulimit -t %d || exit 125\n", limits.MaxCPUSeconds)
+	}
+	return prefix.String()
+}
+
+// killedByResourceLimit reports a command killed for exceeding its CPU time,
+// either directly or as reported by the shell running it. The kernel sends
+// SIGXCPU at the limit; SIGKILL only counts when the CPU time used by the
+// command reached the limit, since it is also sent by the OOM killer or
+// kill -9.
+func killedByResourceLimit(err error, limits commandLimits) string {
+	var exitErr *exec.ExitError
+	if limits.MaxCPUSeconds == 0 || !errors.As(err, &exitErr) {
+		return ""
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return ""
+	}
+	var signal syscall.Signal
+	switch {
+	case status.Signaled():
+		signal = status.Signal()
+	case status.Exited() && status.ExitStatus() > 128:
+		signal = syscall.Signal(status.ExitStatus() - 128)
+	}
+	switch signal {
+	case syscall.SIGXCPU:
+		return "cpu limit"
+	case syscall.SIGKILL:
+		if exitErr.UserTime()+exitErr.SystemTime() >= time.Duration(limits.MaxCPUSeconds)*time.Second-cpuAccountingSlack {
+			return "cpu limit"
+		}
+	}
+	return ""
+}
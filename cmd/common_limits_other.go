@@ -0,0 +1,14 @@
+//go:build !lint && !linux
+// +build !lint,!linux
+
+package cmd
+
+// rlimitPrefix returns nothing: memory and CPU limits are only applied on
+// Linux. Timeouts and output limits work everywhere.
+func rlimitPrefix(limits commandLimits) string {
+	return ""
+}
+
+func killedByResourceLimit(err error, limits commandLimits) string {
+	return ""
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for input, want := range map[string]int64{"": 0, "1048576": 1 << 20, "512K": 512 << 10, "10MB": 10 << 20, "2GiB": 2 << 30, "1g": 1 << 30} {
+		got, err := parseByteSize(input)
+		require.NoError(t, err, input)
+		require.Equal(t, want, got, input)
+	}
+	for _, input := range []string{"ten", "5X", "-1M"} {
+		_, err := parseByteSize(input)
+		require.Error(t, err, input)
+	}
+}
+
+func TestTimeoutIsReportedInResult(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("limits:\n  test:\n    timeout: 200ms\n"), 0644))
+
+	start := time.Now()
+	result, err := executeWithRetries(context.Background(), dir, "sleep 30 & sleep 30; wait", "test", "stored", uuid.New(), 1, 0)
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Len(t, result.Attempts, 1)
+	require.Equal(t, "killed: timeout", result.Attempts[0].Status())
+}
+
+func TestOutputLimitKillsCommand(t *testing.T) {
+	var output bytes.Buffer
+	killed, err := runCommandWithOptions(context.Background(), t.TempDir(), "yes", execOptions{limits: commandLimits{MaxOutputBytes: 1000}}, &output, &output)
+	require.Error(t, err)
+	require.Equal(t, "output limit", killed)
+	require.Equal(t, 1000, output.Len())
+}
+
+func TestCPULimitKillsCommand(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("CPU limits are only applied on Linux")
+	}
+	killed, err := runCommandWithOptions(context.Background(), t.TempDir(), "while :; do :; done", execOptions{limits: commandLimits{MaxCPUSeconds: 1, Timeout: 20 * time.Second}}, &bytes.Buffer{}, &bytes.Buffer{})
+	require.Error(t, err)
+	require.Equal(t, "cpu limit", killed)
+}
+
+func TestOtherKillsAreNotReportedAsCPULimit(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("CPU limits are only applied on Linux")
+	}
+	killed, err := runCommandWithOptions(context.Background(), t.TempDir(), "kill -9 $$", execOptions{limits: commandLimits{MaxCPUSeconds: 10}}, &bytes.Buffer{}, &bytes.Buffer{})
+	require.Error(t, err)
+	require.Empty(t, killed)
+}
+
+func TestMemoryLimitAllowsRuntimeReservations(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("memory limits are only applied on Linux")
+	}
+	goBinary := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(goBinary); err != nil {
+		t.Skip("go is not installed")
+	}
+	var output bytes.Buffer
+	_, err := runCommandWithOptions(context.Background(), t.TempDir(), shellQuote(goBinary)+" version", execOptions{limits: commandLimits{MaxMemory: 256 << 20}}, &output, &output)
+	require.NoError(t, err, output.String())
+}
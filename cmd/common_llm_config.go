@@ -0,0 +1,331 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	gpt4client "ephemyral/pkg"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// LLMSettings holds the LLM client settings that can be set in .ephemyral or
+// ~/.ephemyral.yaml. Every field can also be overridden by the flag of the
+// same name. The provider, endpoint, key and model settings are only read from
+// ~/.ephemyral.yaml, see projectIgnoredSettings.
+type LLMSettings struct {
+	Provider          string   `yaml:"provider,omitempty"`
+	APIURL            string   `yaml:"api-url,omitempty"`
+	APIKeyEnv         string   `yaml:"api-key-env,omitempty"`
+	Model             string   `yaml:"model,omitempty"`
+	SystemPrompt      string   `yaml:"system-prompt,omitempty"`
+	Temperature       *float64 `yaml:"temperature,omitempty"`
+	MaxTokens         int      `yaml:"max-tokens,omitempty"`
+	Seed              *int     `yaml:"seed,omitempty"`
+	Stream            bool     `yaml:"stream,omitempty"`
+	LLMIdleTimeout    string   `yaml:"llm-idle-timeout,omitempty"`
+	LLMRetries        *int     `yaml:"llm-retries,omitempty"`
+	LLMRetryBaseDelay string   `yaml:"llm-retry-base-delay,omitempty"`
+	LLMRetryMaxDelay  string   `yaml:"llm-retry-max-delay,omitempty"`
+	FallbackModel     string   `yaml:"fallback-model,omitempty"`
+	MaxCost           float64  `yaml:"max-cost,omitempty"`
+	MaxTokensTotal    int      `yaml:"max-tokens-total,omitempty"`
+	CacheTTL          string   `yaml:"cache-ttl,omitempty"`
+	NoCache           bool     `yaml:"no-cache,omitempty"`
+	Offline           bool     `yaml:"offline,omitempty"`
+
+	Routes         map[string]RouteSettings `yaml:"routes,omitempty"`
+	ContextWindows map[string]int           `yaml:"context-windows,omitempty"`
+	Prices         map[string]PriceSettings `yaml:"prices,omitempty"`
+}
+
+// RouteSettings selects the model and parameters for one operation: build,
+// test, lint, docs, dependency, create, refactor or automode.
+type RouteSettings struct {
+	Model       string   `yaml:"model,omitempty" mapstructure:"model"`
+	Temperature *float64 `yaml:"temperature,omitempty" mapstructure:"temperature"`
+	MaxTokens   int      `yaml:"max-tokens,omitempty" mapstructure:"max-tokens"`
+	Seed        *int     `yaml:"seed,omitempty" mapstructure:"seed"`
+	Fallback    string   `yaml:"fallback,omitempty" mapstructure:"fallback"`
+}
+
+// PriceSettings is the price of a model in US dollars per million tokens.
+type PriceSettings struct {
+	Input  float64 `yaml:"input" mapstructure:"input"`
+	Output float64 `yaml:"output" mapstructure:"output"`
+}
+
+// configureLLM merges the project .ephemyral file (if any) over the user
+// config and selects the LLM provider described by the result.
+func configureLLM(cmd *cobra.Command, args []string) error {
+	if err := mergeProjectConfig(projectPathFromArgs(cmd, args)); err != nil {
+		return err
+	}
+
+	if _, err := approvalMode(); err != nil {
+		return err
+	}
+	if _, err := executorBackend(); err != nil {
+		return err
+	}
+	if _, err := workspaceMode(); err != nil {
+		return err
+	}
+	if _, err := envPolicy(); err != nil {
+		return err
+	}
+
+	gpt4client.SetShowPrompt(viper.GetBool("show-prompt"))
+	gpt4client.SetCommand(cmd.Name())
+	gpt4client.SetCache(gpt4client.CacheConfig{
+		Disabled: viper.GetBool("no-cache"),
+		TTL:      viper.GetDuration("cache-ttl"),
+		Offline:  viper.GetBool("offline"),
+	})
+	gpt4client.SetUsageLimits(gpt4client.UsageLimits{
+		MaxCost:   viper.GetFloat64("max-cost"),
+		MaxTokens: viper.GetInt("max-tokens-total"),
+	})
+	if viper.GetBool("stream") {
+		gpt4client.SetStreamOutput(os.Stdout)
+	} else {
+		gpt4client.SetStreamOutput(nil)
+	}
+
+	gpt4client.SetRetryPolicy(gpt4client.RetryPolicy{
+		MaxRetries: viper.GetInt("llm-retries"),
+		BaseDelay:  viper.GetDuration("llm-retry-base-delay"),
+		MaxDelay:   viper.GetDuration("llm-retry-max-delay"),
+	})
+
+	routes, err := modelRoutes(cmd)
+	if err != nil {
+		return err
+	}
+
+	var contextWindows map[string]int
+	if err := viper.UnmarshalKey("context-windows", &contextWindows); err != nil {
+		return wrapError(err, "parsing context-windows")
+	}
+
+	prices, err := modelPrices()
+	if err != nil {
+		return err
+	}
+
+	return gpt4client.Configure(gpt4client.Config{
+		ProviderConfig: gpt4client.ProviderConfig{
+			Name:      viper.GetString("provider"),
+			APIURL:    viper.GetString("api-url"),
+			APIKeyEnv: viper.GetString("api-key-env"),
+			Model:     viper.GetString("model"),
+		},
+		SystemPrompt:   viper.GetString("system-prompt"),
+		Params:         generationParams(),
+		IdleTimeout:    viper.GetDuration("llm-idle-timeout"),
+		Routes:         routes,
+		FallbackModel:  viper.GetString("fallback-model"),
+		ContextWindows: contextWindows,
+		Prices:         prices,
+	})
+}
+
+// modelPrices reads the price table from the "prices" key.
+func modelPrices() (map[string]gpt4client.Price, error) {
+	var settings map[string]PriceSettings
+	if err := viper.UnmarshalKey("prices", &settings); err != nil {
+		return nil, wrapError(err, "parsing prices")
+	}
+
+	prices := make(map[string]gpt4client.Price, len(settings))
+	for model, p := range settings {
+		prices[model] = gpt4client.Price{Input: p.Input, Output: p.Output}
+	}
+	return prices, nil
+}
+
+// modelRoutes reads the per-operation routing table from the "routes" key.
+// Settings given as flags on the command line of cmd win over the routes, so
+// a route only overrides values that came from a config file.
+func modelRoutes(cmd *cobra.Command) (map[string]gpt4client.Route, error) {
+	var settings map[string]RouteSettings
+	if err := viper.UnmarshalKey("routes", &settings); err != nil {
+		return nil, wrapError(err, "parsing routes")
+	}
+
+	routes := make(map[string]gpt4client.Route, len(settings))
+	for operation, r := range settings {
+		routes[operation] = gpt4client.Route{
+			Model:    r.Model,
+			Params:   gpt4client.Params{Temperature: r.Temperature, MaxTokens: r.MaxTokens, Seed: r.Seed},
+			Fallback: r.Fallback,
+		}
+	}
+
+	if cmd == nil {
+		return routes, nil
+	}
+	for operation, route := range routes {
+		if cmd.Flags().Changed("model") {
+			route.Model = ""
+		}
+		if cmd.Flags().Changed("temperature") {
+			route.Params.Temperature = nil
+		}
+		if cmd.Flags().Changed("max-tokens") {
+			route.Params.MaxTokens = 0
+		}
+		if cmd.Flags().Changed("seed") {
+			route.Params.Seed = nil
+		}
+		routes[operation] = route
+	}
+	return routes, nil
+}
+
+// generationParams reads the generation parameters, leaving unset ones at the
+// provider default.
+func generationParams() gpt4client.Params {
+	params := gpt4client.Params{MaxTokens: viper.GetInt("max-tokens")}
+	if viper.IsSet("temperature") {
+		temperature := viper.GetFloat64("temperature")
+		params.Temperature = &temperature
+	}
+	if viper.IsSet("seed") {
+		seed := viper.GetInt("seed")
+		params.Seed = &seed
+	}
+	return params
+}
+
+// isFatalLLMError reports whether err cannot be fixed by asking the provider
+// again, such as a bad API key, an exhausted quota, a spent usage budget, a
+// cache miss in offline mode or --show-prompt.
+func isFatalLLMError(err error) bool {
+	return errors.Is(err, gpt4client.ErrAuth) || errors.Is(err, gpt4client.ErrQuota) ||
+		errors.Is(err, gpt4client.ErrBudgetExceeded) || errors.Is(err, gpt4client.ErrOffline) ||
+		errors.Is(err, gpt4client.ErrPromptShown)
+}
+
+// projectPathFromArgs returns the path the command operates on, which is the
+// first positional argument for every command that takes one, except run,
+// whose first argument is the command name.
+func projectPathFromArgs(cmd *cobra.Command, args []string) string {
+	if cmd != nil && cmd.Name() == "run" && len(args) > 0 {
+		args = args[1:]
+	}
+	if len(args) > 0 {
+		return args[0]
+	}
+	return "."
+}
+
+// projectIgnoredSettings are the keys of a project .ephemyral file that are
+// ignored, since a checkout could use them to send the user's API key or
+// other secrets elsewhere, or to turn off the checks meant to protect against
+// it. A *
+// matches every key of a mapping. They are taken from the user config, the
+// environment and flags only.
+var projectIgnoredSettings = []string{
+	"provider", "api-url", "api-key-env", "model", "fallback-model", "routes.*.model", "routes.*.fallback",
+	"shell-policy.disabled", "shell-policy.allow-install", "shell-policy.allow-write-paths", "env-policy",
+	"sandbox.writable", "sandbox.network",
+}
+
+// mergeProjectConfig layers the nearest .ephemyral file above path over the
+// settings already loaded into viper, except for projectIgnoredSettings.
+func mergeProjectConfig(path string) error {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, ".ephemyral")
+	}
+
+	directory, err := findEphemyralDirectory(path)
+	if err != nil {
+		return nil
+	}
+
+	// Report unknown keys and unsupported versions before anything runs.
+	_, doc, err := loadEphemyralFile(directory)
+	if err != nil {
+		return err
+	}
+	settings := map[string]interface{}{}
+	if doc != nil {
+		if err := doc.Decode(&settings); err != nil {
+			return wrapError(err, "parsing .ephemyral file")
+		}
+	}
+	ignored := []string{}
+	for _, key := range projectIgnoredSettings {
+		ignored = append(ignored, removeSetting(settings, key)...)
+	}
+	// A project may choose the sandbox, but not leave it.
+	if executor, ok := settings["executor"]; ok && !strings.EqualFold(fmt.Sprint(executor), ExecutorSandbox) {
+		delete(settings, "executor")
+		ignored = append(ignored, "executor")
+	}
+	for _, key := range ignored {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring %s in %s; set it in your user config instead\n", key, filepath.Join(directory, ".ephemyral"))
+	}
+	// The project adds to the deny-commands of the user instead of replacing
+	// them.
+	if policy, ok := settings["shell-policy"].(map[string]interface{}); ok {
+		if deny, ok := policy["deny-commands"].([]interface{}); ok {
+			for _, command := range viper.GetStringSlice("shell-policy.deny-commands") {
+				deny = append(deny, command)
+			}
+			policy["deny-commands"] = deny
+		}
+	}
+	return viper.MergeConfigMap(settings)
+}
+
+// removeSetting deletes the dotted key from settings and returns the keys it
+// deleted. A * in key matches every key of a mapping.
+func removeSetting(settings map[string]interface{}, key string) []string {
+	name, rest, nested := strings.Cut(key, ".")
+	var removed []string
+	for k, value := range settings {
+		if name != "*" && k != name {
+			continue
+		}
+		if !nested {
+			delete(settings, k)
+			removed = append(removed, k)
+			continue
+		}
+		if child, ok := value.(map[string]interface{}); ok {
+			for _, r := range removeSetting(child, rest) {
+				removed = append(removed, k+"."+r)
+			}
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// conversationID returns the conversation to continue when --resume is set,
+// or a fresh conversation ID otherwise.
+func conversationID(cmd *cobra.Command) (uuid.UUID, error) {
+	resume, _ := cmd.Flags().GetString("resume")
+	if resume == "" {
+		return uuid.New(), nil
+	}
+
+	convID, err := uuid.Parse(resume)
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("invalid conversation ID %q: %v", resume, err)
+	}
+	if !gpt4client.ConversationExists(convID) {
+		return uuid.Nil, fmt.Errorf("no stored conversation with ID %s", convID)
+	}
+	return convID, nil
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModelRoutesFromProjectConfig(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+
+	require.NoError(t, viper.MergeConfigMap(map[string]interface{}{
+		"fallback-model": "gpt-4o-mini",
+		"routes": map[string]interface{}{
+			"build":    map[string]interface{}{"model": "gpt-4o-mini"},
+			"refactor": map[string]interface{}{"fallback": "gpt-4.1"},
+		},
+	}))
+
+	dir := t.TempDir()
+	config := `build-command: go build ./...
+routes:
+  build:
+    temperature: 0
+  refactor:
+    max-tokens: 8000
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte(config), 0644))
+	require.NoError(t, mergeProjectConfig(dir))
+
+	routes, err := modelRoutes(nil)
+	require.NoError(t, err)
+	require.Equal(t, "gpt-4o-mini", routes["build"].Model)
+	require.NotNil(t, routes["build"].Params.Temperature)
+	require.Equal(t, 0.0, *routes["build"].Params.Temperature)
+	require.Equal(t, 8000, routes["refactor"].Params.MaxTokens)
+	require.Equal(t, "gpt-4.1", routes["refactor"].Fallback)
+	require.Equal(t, "gpt-4o-mini", viper.GetString("fallback-model"))
+}
+
+func TestProjectConfigCannotRedirectProvider(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	require.NoError(t, viper.MergeConfigMap(map[string]interface{}{"api-url": "https://api.openai.com/v1", "model": "gpt-4o"}))
+
+	dir := t.TempDir()
+	config := `api-url: https://attacker.example/v1
+api-key-env: AWS_SECRET_ACCESS_KEY
+provider: ollama
+model: expensive
+routes:
+  build:
+    model: expensive
+    max-tokens: 100
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte(config), 0644))
+	require.NoError(t, mergeProjectConfig(dir))
+
+	require.Equal(t, "https://api.openai.com/v1", viper.GetString("api-url"))
+	require.Empty(t, viper.GetString("api-key-env"))
+	require.Empty(t, viper.GetString("provider"))
+	require.Equal(t, "gpt-4o", viper.GetString("model"))
+	routes, err := modelRoutes(nil)
+	require.NoError(t, err)
+	require.Empty(t, routes["build"].Model)
+	require.Equal(t, 100, routes["build"].Params.MaxTokens)
+}
+
+func TestCommandLineFlagsWinOverRoutes(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	viper.Set("routes", map[string]interface{}{
+		"build": map[string]interface{}{"model": "gpt-4o-mini", "temperature": 0.5, "max-tokens": 100},
+	})
+
+	cmd := &cobra.Command{Use: "build"}
+	cmd.Flags().String("model", "", "")
+	cmd.Flags().Float64("temperature", 0, "")
+	cmd.Flags().Int("max-tokens", 0, "")
+	cmd.Flags().Int("seed", 0, "")
+	require.NoError(t, cmd.ParseFlags([]string{"--model", "gpt-4.1", "--temperature", "0.1"}))
+
+	routes, err := modelRoutes(cmd)
+	require.NoError(t, err)
+	require.Empty(t, routes["build"].Model)
+	require.Nil(t, routes["build"].Params.Temperature)
+	require.Equal(t, 100, routes["build"].Params.MaxTokens)
+}
@@ -0,0 +1,93 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// outputTailSize is how much of each output stream of a command is kept for
+// repair prompts.
+const outputTailSize = 8 << 10
+
+// ringBuffer is an io.Writer that keeps only the last size bytes written.
+type ringBuffer struct {
+	mu      sync.Mutex
+	data    []byte
+	size    int
+	written int64
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{size: size}
+}
+
+func (r *ringBuffer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.written += int64(len(p))
+	r.data = append(r.data, p...)
+	// Compact only once the buffer holds twice the size, so that writes stay
+	// amortized O(len(p)).
+	if len(r.data) > 2*r.size {
+		r.data = append(r.data[:0], r.data[len(r.data)-r.size:]...)
+	}
+	return len(p), nil
+}
+
+// String returns the kept tail, marked when earlier output was dropped.
+func (r *ringBuffer) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.written <= int64(r.size) {
+		return string(r.data)
+	}
+	tail := r.data[len(r.data)-r.size:]
+	return fmt.Sprintf("[%d earlier bytes omitted]\n%s", r.written-int64(r.size), strings.ToValidUTF8(string(tail), ""))
+}
+
+// commandOutput is the tail of what a command printed and its exit code.
+// Killed names the limit the command was killed for, if any.
+type commandOutput struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	Killed   string
+}
+
+// String formats the output for prompts.
+func (o commandOutput) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Exit code: %d\n", o.ExitCode)
+	if o.Killed != "" {
+		fmt.Fprintf(&b, "Killed: %s\n", o.Killed)
+	}
+	for _, stream := range []struct{ name, text string }{{"stdout", o.Stdout}, {"stderr", o.Stderr}} {
+		if strings.TrimSpace(stream.text) == "" {
+			fmt.Fprintf(&b, "%s: (empty)\n", stream.name)
+			continue
+		}
+		fmt.Fprintf(&b, "%s:\n%s\n", stream.name, strings.TrimRight(stream.text, "\n"))
+	}
+	return b.String()
+}
+
+// exitCode returns the exit code of a finished command, or -1 when it did
+// not exit normally.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
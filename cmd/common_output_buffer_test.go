@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingBufferKeepsTail(t *testing.T) {
+	buf := newRingBuffer(8)
+	buf.Write([]byte("abc"))
+	require.Equal(t, "abc", buf.String())
+
+	for i := 0; i < 10; i++ {
+		buf.Write([]byte("0123456789"))
+	}
+	require.Equal(t, "[95 earlier bytes omitted]\n23456789", buf.String())
+	require.LessOrEqual(t, len(buf.data), 2*8+10)
+}
+
+func TestCommandOutputForPrompt(t *testing.T) {
+	output := commandOutput{Stderr: "undefined: foo\n", ExitCode: 2}
+	text := output.String()
+	require.True(t, strings.HasPrefix(text, "Exit code: 2\n"))
+	require.Contains(t, text, "stdout: (empty)")
+	require.Contains(t, text, "stderr:\nundefined: foo\n")
+}
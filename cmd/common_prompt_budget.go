@@ -0,0 +1,108 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	gpt4client "ephemyral/pkg"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fitFileList joins files for a prompt of operation. Files closest to the
+// project root are listed first; when the list does not fit into half of the
+// prompt budget the remaining files are summarised by extension.
+func fitFileList(operation string, files []string) string {
+	budget, _ := gpt4client.Budget(operation)
+	budget /= 2
+
+	files = uniqueFiles(files)
+	sort.SliceStable(files, func(i, j int) bool {
+		return strings.Count(files[i], string(filepath.Separator)) < strings.Count(files[j], string(filepath.Separator))
+	})
+
+	var listed []string
+	used := 0
+	for i, file := range files {
+		tokens := gpt4client.CountPromptTokens(operation, file+"\n")
+		if used+tokens > budget {
+			summary := summarizeFiles(files[i:])
+			fmt.Printf("Warning: listing %d of %d files to stay within the token budget of %s\n", i, len(files), operation)
+			return strings.Join(append(listed, summary), "\n")
+		}
+		listed = append(listed, file)
+		used += tokens
+	}
+	return strings.Join(listed, "\n")
+}
+
+// uniqueFiles returns files without duplicates, keeping the first occurrence.
+func uniqueFiles(files []string) []string {
+	seen := make(map[string]bool, len(files))
+	unique := make([]string, 0, len(files))
+	for _, file := range files {
+		if !seen[file] {
+			seen[file] = true
+			unique = append(unique, file)
+		}
+	}
+	return unique
+}
+
+// summarizeFiles describes files that were left out of a prompt by counting
+// them per extension.
+func summarizeFiles(files []string) string {
+	counts := map[string]int{}
+	for _, file := range files {
+		ext := filepath.Ext(file)
+		if ext == "" {
+			ext = "(no extension)"
+		}
+		counts[ext]++
+	}
+
+	exts := make([]string, 0, len(counts))
+	for ext := range counts {
+		exts = append(exts, ext)
+	}
+	sort.Slice(exts, func(i, j int) bool {
+		if counts[exts[i]] != counts[exts[j]] {
+			return counts[exts[i]] > counts[exts[j]]
+		}
+		return exts[i] < exts[j]
+	})
+
+	parts := make([]string, len(exts))
+	for i, ext := range exts {
+		parts[i] = fmt.Sprintf("%d %s", counts[ext], ext)
+	}
+	return fmt.Sprintf("... and %d more files not listed: %s", len(files), strings.Join(parts, ", "))
+}
+
+// splitByTokens splits text at line boundaries into parts of at most limit
+// tokens for operation. A single line longer than limit becomes its own part.
+func splitByTokens(operation, text string, limit int) []string {
+	if gpt4client.CountPromptTokens(operation, text) <= limit {
+		return []string{text}
+	}
+
+	var parts []string
+	var current strings.Builder
+	used := 0
+	for _, line := range strings.SplitAfter(text, "\n") {
+		tokens := gpt4client.CountPromptTokens(operation, line)
+		if used > 0 && used+tokens > limit {
+			parts = append(parts, current.String())
+			current.Reset()
+			used = 0
+		}
+		current.WriteString(line)
+		used += tokens
+	}
+	if current.Len() > 0 {
+		parts = append(parts, current.String())
+	}
+	return parts
+}
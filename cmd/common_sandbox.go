@@ -0,0 +1,91 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Executor backends: run commands directly, or isolated from the network and
+// from the file system outside the project.
+const (
+	ExecutorLocal   = "local"
+	ExecutorSandbox = "sandbox"
+)
+
+// SandboxSettings configures the sandbox executor.
+type SandboxSettings struct {
+	// Network lists the command types that may use the network.
+	Network []string `yaml:"network,omitempty" mapstructure:"network"`
+	// Writable lists paths outside the project that commands may write to,
+	// such as build caches. Relative paths are relative to the project.
+	Writable []string `yaml:"writable,omitempty" mapstructure:"writable"`
+}
+
+// sandboxOptions are the sandbox settings that apply to one command type.
+type sandboxOptions struct {
+	network  bool
+	writable []string
+	// tmpDir is the private, writable TMPDIR of one run.
+	tmpDir string
+}
+
+// executorBackend returns the configured executor backend.
+func executorBackend() (string, error) {
+	switch backend := strings.ToLower(viper.GetString("executor")); backend {
+	case "", ExecutorLocal:
+		return ExecutorLocal, nil
+	case ExecutorSandbox:
+		return backend, nil
+	default:
+		return "", fmt.Errorf("invalid executor %q: use local or sandbox", backend)
+	}
+}
+
+// sandboxOptionsFor returns the sandbox options of commandType, or nil when
+// commands run locally.
+func sandboxOptionsFor(directory, commandType string) (*sandboxOptions, error) {
+	backend, err := executorBackend()
+	if err != nil || backend == ExecutorLocal {
+		return nil, err
+	}
+
+	// The settings are only read from the user config, see
+	// projectIgnoredSettings.
+	var settings SandboxSettings
+	if err := viper.UnmarshalKey("sandbox", &settings); err != nil {
+		return nil, wrapError(err, "parsing sandbox")
+	}
+	home, _ := os.UserHomeDir()
+	opts := &sandboxOptions{network: containsString(settings.Network, commandType)}
+	for _, path := range settings.Writable {
+		if path == "~" || strings.HasPrefix(path, "~/") {
+			path = home + path[1:]
+		} else if !filepath.IsAbs(path) {
+			path = filepath.Join(directory, path)
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		opts.writable = append(opts.writable, abs)
+	}
+	return opts, nil
+}
+
+// withTmpDir returns env with TMPDIR set to dir.
+func withTmpDir(env []string, dir string) []string {
+	result := []string{"TMPDIR=" + dir}
+	for _, entry := range env {
+		if !strings.HasPrefix(entry, "TMPDIR=") {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
@@ -0,0 +1,95 @@
+//go:build !lint && linux
+// +build !lint,linux
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// sandboxCommand returns a process running script in directory with only the
+// project and the writable paths of opts writable, and without network
+// unless allowed. It uses bubblewrap when installed and otherwise sets up
+// user, mount and network namespaces itself, running the command in a nested
+// user namespace that has no privileges over the mounts.
+func sandboxCommand(ctx context.Context, directory, script string, opts execOptions) (*exec.Cmd, error) {
+	project, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, err
+	}
+	writable := append([]string{project, opts.sandbox.tmpDir}, opts.sandbox.writable...)
+	for _, path := range writable {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, fmt.Errorf("sandbox: %v", err)
+		}
+	}
+
+	if bwrap, err := exec.LookPath("bwrap"); err == nil {
+		args := []string{"--ro-bind", "/", "/", "--dev", "/dev", "--proc", "/proc", "--unshare-pid", "--die-with-parent"}
+		if !opts.sandbox.network {
+			args = append(args, "--unshare-net")
+		}
+		for _, path := range writable {
+			args = append(args, "--bind", path, path)
+		}
+		args = append(args, "--chdir", opts.dir(project), "--", opts.shellCmd(), BashOpt, script)
+		return exec.CommandContext(ctx, bwrap, args...), nil
+	}
+
+	// The namespace that owns the mounts must not be the one the command
+	// runs in, or it could remount the file system writable again.
+	unshare, err := exec.LookPath("unshare")
+	if err != nil {
+		return nil, errors.New("sandbox: neither bwrap nor unshare is installed")
+	}
+	script = fmt.Sprintf("exec %s --user --map-user=%d --map-group=%d -- %s %s %s",
+		shellQuote(unshare), os.Getuid(), os.Getgid(), shellQuote(opts.shellCmd()), BashOpt, shellQuote(script))
+	cmd := exec.CommandContext(ctx, BashCmd, BashOpt, namespaceSetup(writable)+script)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:                 syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+		GidMappings:                []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		GidMappingsEnableSetgroups: false,
+	}
+	if !opts.sandbox.network {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	return cmd, nil
+}
+
+// namespaceSetup returns shell lines that, run in fresh user and mount
+// namespaces, bind the writable paths onto themselves and remount every
+// other mount read-only, failing with exit status 125 when a mount cannot be
+// made read-only. Flags the kernel locks for unprivileged namespaces are
+// kept, since a remount may not clear them. The working directory is entered
+// again so that it refers to the writable bind mount. /proc stays writable
+// for the nested user namespace to write its ID maps.
+func namespaceSetup(writable []string) string {
+	var b strings.Builder
+	patterns := []string{"/proc"}
+	for _, path := range writable {
+		quoted := shellQuote(path)
+		fmt.Fprintf(&b, "mount --bind %s %s || exit 125\n", quoted, quoted)
+		patterns = append(patterns, quoted, quoted+"/*")
+	}
+	fmt.Fprintf(&b, `while read -r _ target _ options _; do
+  target=$(printf '%%b' "$target")
+  case "$target" in %s) continue ;; esac
+  case "$options" in ro|ro,*) continue ;; esac
+  flags=ro
+  for option in $(echo "$options" | tr , ' '); do
+    case "$option" in nosuid|nodev|noexec|noatime|nodiratime|relatime|strictatime) flags="$flags,$option" ;; esac
+  done
+  mount -o "remount,bind,$flags" "$target" || exit 125
+done < /proc/self/mounts
+cd "$PWD" || exit 125
+`, strings.Join(patterns, "|"))
+	return b.String()
+}
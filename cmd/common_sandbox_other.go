@@ -0,0 +1,15 @@
+//go:build !lint && !linux
+// +build !lint,!linux
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+// sandboxCommand fails: the sandbox executor needs Linux namespaces.
+func sandboxCommand(ctx context.Context, directory, script string, opts execOptions) (*exec.Cmd, error) {
+	return nil, errors.New("the sandbox executor is only available on Linux")
+}
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSandboxIsolatesFilesAndNetwork(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the sandbox executor is only available on Linux")
+	}
+	viper.Set("executor", ExecutorSandbox)
+	viper.Set("sandbox", map[string]interface{}{"network": []string{"build"}})
+	defer viper.Reset()
+
+	project, outside := t.TempDir(), t.TempDir()
+	opts, err := execOptionsFor(project, "test")
+	require.NoError(t, err)
+	require.NotNil(t, opts.sandbox)
+	require.False(t, opts.sandbox.network)
+
+	run := func(command string) (string, error) {
+		var output bytes.Buffer
+		_, err := runCommandWithOptions(context.Background(), project, command, opts, &output, &output)
+		return output.String(), err
+	}
+	if _, err := run("true"); err != nil {
+		t.Skipf("namespaces are not available here: %v", err)
+	}
+
+	output, err := run("echo ok > inside.txt && echo tmp > $TMPDIR/scratch")
+	require.NoError(t, err, output)
+	require.FileExists(t, filepath.Join(project, "inside.txt"))
+
+	output, err = run("echo no > " + shellQuote(filepath.Join(outside, "outside.txt")))
+	require.Error(t, err)
+	require.Contains(t, output, "Read-only file system")
+	require.NoFileExists(t, filepath.Join(outside, "outside.txt"))
+
+	// Mounts cannot be made writable again, also not from a new namespace.
+	remount := `while read -r _ target _; do mount -o remount,bind,rw "$target" 2>/dev/null; done < /proc/self/mounts; echo no > ` + shellQuote(filepath.Join(outside, "outside.txt"))
+	output, err = run(remount)
+	require.Error(t, err)
+	require.Contains(t, output, "Read-only file system")
+	output, err = run("unshare --user --map-root-user --mount sh -c " + shellQuote(remount))
+	require.Error(t, err)
+	require.NoFileExists(t, filepath.Join(outside, "outside.txt"), output)
+
+	output, err = run(`awk -F: 'NR > 2 { gsub(/ /, "", $1); print $1 }' /proc/net/dev`)
+	require.NoError(t, err)
+	require.Equal(t, "lo", strings.TrimSpace(output))
+}
+
+func TestExecutorDefaultsToLocal(t *testing.T) {
+	defer viper.Reset()
+	opts, err := execOptionsFor(t.TempDir(), "build")
+	require.NoError(t, err)
+	require.Nil(t, opts.sandbox)
+
+	viper.Set("executor", "docker")
+	_, err = execOptionsFor(t.TempDir(), "build")
+	require.Error(t, err)
+}
+
+func TestProjectFileCannotLeaveOrWidenSandbox(t *testing.T) {
+	viper.Reset()
+	defer viper.Reset()
+	require.NoError(t, viper.MergeConfigMap(map[string]interface{}{"executor": ExecutorSandbox}))
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("executor: local\nsandbox:\n  network: [test]\n  writable: [/]\n"), 0644))
+	require.NoError(t, mergeProjectConfig(dir))
+	opts, err := execOptionsFor(dir, "test")
+	require.NoError(t, err)
+	require.NotNil(t, opts.sandbox)
+	require.False(t, opts.sandbox.network)
+	require.Empty(t, opts.sandbox.writable)
+
+	viper.Reset()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("executor: sandbox\n"), 0644))
+	require.NoError(t, mergeProjectConfig(dir))
+	backend, err := executorBackend()
+	require.NoError(t, err)
+	require.Equal(t, ExecutorSandbox, backend)
+}
@@ -0,0 +1,403 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// ShellPolicySettings configures the checks every shell command has to pass
+// before it runs. It is read from the "shell-policy" key. The .ephemyral file
+// of a project can only tighten it: its deny-commands are added to those of
+// the user config and the other fields are ignored.
+type ShellPolicySettings struct {
+	Disabled     bool     `yaml:"disabled,omitempty" mapstructure:"disabled"`
+	AllowInstall bool     `yaml:"allow-install,omitempty" mapstructure:"allow-install"`
+	DenyCommands []string `yaml:"deny-commands,omitempty" mapstructure:"deny-commands"`
+	// AllowWritePaths are directories outside the project that commands may
+	// write to, relative to the project root or absolute.
+	AllowWritePaths []string `yaml:"allow-write-paths,omitempty" mapstructure:"allow-write-paths"`
+}
+
+// PolicyViolation reports the part of a command that breaks the shell policy.
+type PolicyViolation struct {
+	Rule   string
+	Reason string
+	// Node is the source of the offending syntax node, found at Pos.
+	Node string
+	Pos  syntax.Pos
+}
+
+func (v *PolicyViolation) Error() string {
+	return fmt.Sprintf("shell policy %s: %s at %s: %s", v.Rule, v.Reason, v.Pos, v.Node)
+}
+
+var (
+	privilegeCommands = []string{"sudo", "su", "doas", "pkexec"}
+	interpreters      = []string{"sh", "bash", "zsh", "dash", "ksh", "fish", "python", "python3", "perl", "ruby", "node", "eval", "source", "."}
+	downloadCommands  = []string{"curl", "wget", "fetch"}
+	// wrapperCommands run the command given in their arguments.
+	wrapperCommands = []string{"env", "command", "exec", "nice", "nohup", "time", "timeout", "xargs"}
+	// writingCommands modify the paths given in their arguments.
+	writingCommands = []string{"rm", "rmdir", "touch", "mkdir", "tee", "truncate", "chmod", "chown", "cp", "mv", "ln", "install"}
+)
+
+// shellPolicy returns the configured policy; --allow-install overrides the
+// allow-install setting.
+func shellPolicy() (ShellPolicySettings, error) {
+	var policy ShellPolicySettings
+	if err := viper.UnmarshalKey("shell-policy", &policy); err != nil {
+		return policy, wrapError(err, "parsing shell-policy")
+	}
+	if viper.GetBool("allow-install") {
+		policy.AllowInstall = true
+	}
+	return policy, nil
+}
+
+// isPolicyViolation reports whether err is a *PolicyViolation.
+func isPolicyViolation(err error) bool {
+	var violation *PolicyViolation
+	return errors.As(err, &violation)
+}
+
+// checkShellPolicy parses command as bash and returns the first
+// *PolicyViolation found when it runs in directory, the project root.
+func checkShellPolicy(directory, command string) error {
+	return checkShellPolicyIn(directory, directory, command)
+}
+
+// checkShellPolicyIn is checkShellPolicy for a command that starts in
+// workDir, a directory of the project.
+func checkShellPolicyIn(directory, workDir, command string) error {
+	policy, err := shellPolicy()
+	if err != nil || policy.Disabled {
+		return err
+	}
+
+	file, err := syntax.NewParser(syntax.Variant(syntax.LangBash)).Parse(strings.NewReader(command), "")
+	if err != nil {
+		return &PolicyViolation{Rule: "parse", Reason: err.Error(), Node: command}
+	}
+
+	root, err := filepath.Abs(directory)
+	if err != nil {
+		return err
+	}
+	cwd, err := filepath.Abs(workDir)
+	if err != nil {
+		return err
+	}
+	home, _ := os.UserHomeDir()
+	c := &policyChecker{policy: policy, source: command, root: root, home: home, cwd: cwd, cwdKnown: true}
+	c.writable = []string{root, os.TempDir()}
+	for _, p := range policy.AllowWritePaths {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(root, p)
+		}
+		c.writable = append(c.writable, filepath.Clean(p))
+	}
+
+	syntax.Walk(file, func(node syntax.Node) bool {
+		switch n := node.(type) {
+		case *syntax.CallExpr:
+			c.checkCall(n)
+		case *syntax.BinaryCmd:
+			if (n.Op == syntax.Pipe || n.Op == syntax.PipeAll) && containsCall(n.X, downloadCommands) && containsCall(n.Y, interpreters) {
+				c.report(n, "download-exec", "downloaded content is piped into an interpreter")
+			}
+		case *syntax.Redirect:
+			switch n.Op {
+			case syntax.RdrOut, syntax.AppOut, syntax.RdrInOut, syntax.ClbOut, syntax.RdrAll, syntax.AppAll:
+				c.checkWrite(n, n.Word)
+			}
+		}
+		return c.violation == nil
+	})
+	if c.violation != nil {
+		return c.violation
+	}
+	return nil
+}
+
+// policyChecker walks a command in source order. It follows cd commands with
+// literal arguments so that relative paths resolve against the directory
+// they are used in.
+type policyChecker struct {
+	policy    ShellPolicySettings
+	source    string
+	root      string
+	home      string
+	cwd       string
+	cwdKnown  bool
+	writable  []string
+	violation *PolicyViolation
+}
+
+func (c *policyChecker) report(node syntax.Node, rule, reason string) {
+	if c.violation != nil {
+		return
+	}
+	c.violation = &PolicyViolation{
+		Rule:   rule,
+		Reason: reason,
+		Node:   c.source[node.Pos().Offset():node.End().Offset()],
+		Pos:    node.Pos(),
+	}
+}
+
+func (c *policyChecker) checkCall(call *syntax.CallExpr) {
+	words := commandWords(call)
+	if len(words) == 0 {
+		return
+	}
+	name := commandName(words[0])
+	args := words[1:]
+
+	switch {
+	case containsString(privilegeCommands, name):
+		c.report(call, "privilege", name+" is not allowed")
+	case containsString(c.policy.DenyCommands, name):
+		c.report(call, "deny-commands", name+" is on the deny-commands list")
+	case containsString(interpreters, name) && containsCall(&syntax.CallExpr{Args: args}, downloadCommands):
+		c.report(call, "download-exec", "downloaded content is run by an interpreter")
+	case !c.policy.AllowInstall && installsPackages(name, literals(args)):
+		c.report(call, "install", "installing packages requires --allow-install")
+	case name == "cd":
+		c.changeDir(args)
+	case name == "rm" && isRecursive(literals(args)):
+		for _, target := range operands(args) {
+			if path, ok := c.resolve(target); ok && c.isCritical(path) {
+				c.report(call, "recursive-delete", "recursive delete of "+path)
+			}
+		}
+	}
+
+	if containsString(writingCommands, name) {
+		for _, target := range writeTargets(name, args) {
+			c.checkWrite(call, target)
+		}
+	}
+}
+
+func (c *policyChecker) checkWrite(node syntax.Node, target *syntax.Word) {
+	path, ok := c.resolve(target)
+	if !ok || strings.HasPrefix(path, "/dev/") {
+		return
+	}
+	for _, dir := range c.writable {
+		if withinDir(path, dir) {
+			return
+		}
+	}
+	c.report(node, "write-outside-project", path+" is outside the project")
+}
+
+func (c *policyChecker) changeDir(args []*syntax.Word) {
+	targets := operands(args)
+	if len(targets) == 0 {
+		c.cwd, c.cwdKnown = c.home, c.home != ""
+		return
+	}
+	c.cwd, c.cwdKnown = c.resolve(targets[0])
+}
+
+// isCritical reports whether deleting path recursively would delete the
+// file system root, a top-level directory, the home directory or the project.
+func (c *policyChecker) isCritical(path string) bool {
+	return path == "/" || filepath.Dir(path) == "/" || path == c.home || withinDir(c.root, path)
+}
+
+// resolve returns the absolute path named by w, if it can be known without
+// running the command. Globs resolve to the directory they expand in.
+func (c *policyChecker) resolve(w *syntax.Word) (string, bool) {
+	var b strings.Builder
+	for i, part := range w.Parts {
+		switch p := part.(type) {
+		case *syntax.Lit:
+			value := p.Value
+			if i == 0 && (value == "~" || strings.HasPrefix(value, "~/")) {
+				value = c.home + value[1:]
+			}
+			b.WriteString(value)
+		case *syntax.SglQuoted:
+			b.WriteString(p.Value)
+		case *syntax.DblQuoted:
+			for _, q := range p.Parts {
+				lit, ok := q.(*syntax.Lit)
+				if !ok {
+					return "", false
+				}
+				b.WriteString(lit.Value)
+			}
+		case *syntax.ParamExp:
+			if i != 0 || p.Param == nil || p.Param.Value != "HOME" || p.Exp != nil || p.Repl != nil || p.Slice != nil || p.Index != nil || p.Length || p.Excl {
+				return "", false
+			}
+			b.WriteString(c.home)
+		default:
+			return "", false
+		}
+	}
+
+	path := b.String()
+	if path == "" {
+		return "", false
+	}
+	for strings.ContainsAny(path, "*?[") {
+		path = filepath.Dir(path)
+	}
+	if !filepath.IsAbs(path) {
+		if !c.cwdKnown {
+			return "", false
+		}
+		path = filepath.Join(c.cwd, path)
+	}
+	return filepath.Clean(path), true
+}
+
+// commandWords returns the words of call without leading wrappers such as
+// env or nohup and their options, so that the command they run is checked.
+func commandWords(call *syntax.CallExpr) []*syntax.Word {
+	words := call.Args
+	for len(words) > 0 && containsString(wrapperCommands, commandName(words[0])) {
+		words = words[1:]
+		for len(words) > 0 {
+			lit := words[0].Lit()
+			isOption := strings.HasPrefix(lit, "-") || strings.Contains(lit, "=")
+			isNumber := lit != "" && strings.Trim(lit, "0123456789.smhd") == ""
+			if !isOption && !isNumber {
+				break
+			}
+			words = words[1:]
+		}
+	}
+	return words
+}
+
+func commandName(w *syntax.Word) string {
+	if lit := w.Lit(); lit != "" {
+		return filepath.Base(lit)
+	}
+	return ""
+}
+
+// containsCall reports whether node runs one of names anywhere, including in
+// command substitutions.
+func containsCall(node syntax.Node, names []string) bool {
+	found := false
+	syntax.Walk(node, func(n syntax.Node) bool {
+		if call, ok := n.(*syntax.CallExpr); ok {
+			if words := commandWords(call); len(words) > 0 && containsString(names, commandName(words[0])) {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// installsPackages reports whether a command installs packages for the
+// system or the user. Installs into the project, like npm install, are not
+// counted.
+func installsPackages(name string, args []string) bool {
+	sub := ""
+	if ops := nonOptions(args); len(ops) > 0 {
+		sub = ops[0]
+	}
+	switch name {
+	case "apt", "apt-get", "aptitude", "yum", "dnf", "brew", "port", "snap", "choco", "winget", "scoop", "gem", "cargo", "go", "pip", "pip3", "pipx", "conda":
+		return sub == "install"
+	case "zypper":
+		return sub == "install" || sub == "in"
+	case "apk":
+		return sub == "add"
+	case "pacman":
+		for _, a := range args {
+			if strings.HasPrefix(a, "-S") {
+				return true
+			}
+		}
+	case "npm", "pnpm":
+		return (sub == "install" || sub == "i" || sub == "add") && (containsString(args, "-g") || containsString(args, "--global"))
+	case "yarn":
+		return sub == "global"
+	case "python", "python3":
+		return len(args) >= 3 && args[0] == "-m" && strings.HasPrefix(args[1], "pip") && args[2] == "install"
+	}
+	return false
+}
+
+func isRecursive(args []string) bool {
+	for _, a := range args {
+		if a == "--recursive" || (strings.HasPrefix(a, "-") && !strings.HasPrefix(a, "--") && strings.ContainsAny(a, "rR")) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTargets returns the arguments of a writing command that it writes to.
+func writeTargets(name string, args []*syntax.Word) []*syntax.Word {
+	for i, a := range args {
+		if a.Lit() == "-t" && i+1 < len(args) {
+			return args[i+1 : i+2]
+		}
+	}
+	targets := operands(args)
+	switch name {
+	case "cp", "mv", "ln", "install":
+		if len(targets) > 1 {
+			return targets[len(targets)-1:]
+		}
+		return nil
+	case "chmod", "chown":
+		if len(targets) > 0 {
+			return targets[1:]
+		}
+	}
+	return targets
+}
+
+// operands returns the words that are not options.
+func operands(args []*syntax.Word) []*syntax.Word {
+	var result []*syntax.Word
+	for _, a := range args {
+		if !strings.HasPrefix(a.Lit(), "-") {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+func nonOptions(args []string) []string {
+	var result []string
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+func literals(words []*syntax.Word) []string {
+	result := make([]string, len(words))
+	for i, w := range words {
+		result[i] = w.Lit()
+	}
+	return result
+}
+
+// withinDir reports whether path is dir or inside it.
+func withinDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && filepath.IsLocal(rel)
+}
@@ -3,7 +3,9 @@
 package cmd
 
 import (
+	"context"
 	"strings"
+	"time"
 )
 
 func filterOutCodeBlocks(content string) string {
@@ -21,3 +23,15 @@ func filterOutCodeBlocks(content string) string {
 	}
 	return result
 }
+
+// sleepContext waits for d or until ctx is cancelled, whichever comes first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,317 @@
+//go:build !lint
+// +build !lint
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Workspace modes: change the project directly, or verify changes in a
+// scratch copy or a git worktree of it first.
+const (
+	WorkspaceInPlace  = "in-place"
+	WorkspaceCopy     = "copy"
+	WorkspaceWorktree = "worktree"
+)
+
+// workspace is a scratch copy of a project. Files written to it and commands
+// stored by ephemyral in its .ephemyral file are copied back to the project
+// by commit; everything else the commands leave behind is discarded by
+// remove.
+type workspace struct {
+	project string
+	// dir is the scratch copy of project.
+	dir string
+	// cleanup removes the scratch copy.
+	cleanup func() error
+	changed map[string][]byte
+	// stored holds the commands generated in the copy, by name. It is guarded
+	// by ephemyralFileMu.
+	stored map[string]GeneratedCommand
+}
+
+// activeWorkspaces maps the scratch copies in use to their workspace, so that
+// approvals and commands stored in a copy apply to its project.
+var (
+	activeWorkspacesMu sync.Mutex
+	activeWorkspaces   = map[string]*workspace{}
+)
+
+// projectPath returns where path, which may be inside a scratch copy, is in
+// the project, and the workspace of that copy, or nil.
+func projectPath(path string) (string, *workspace, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", nil, err
+	}
+	activeWorkspacesMu.Lock()
+	defer activeWorkspacesMu.Unlock()
+	for dir, w := range activeWorkspaces {
+		if rel, err := filepath.Rel(dir, abs); err == nil && (rel == "." || filepath.IsLocal(rel)) {
+			return filepath.Join(w.project, rel), w, nil
+		}
+	}
+	return abs, nil, nil
+}
+
+// workspaceMode returns the configured workspace mode.
+func workspaceMode() (string, error) {
+	switch mode := strings.ToLower(viper.GetString("workspace")); mode {
+	case "", WorkspaceInPlace:
+		return WorkspaceInPlace, nil
+	case WorkspaceCopy, WorkspaceWorktree:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid workspace %q: use in-place, copy or worktree", mode)
+	}
+}
+
+// newWorkspace creates a scratch copy of project in mode copy or worktree.
+func newWorkspace(ctx context.Context, mode, project string) (*workspace, error) {
+	project, err := filepath.Abs(project)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := os.MkdirTemp("", "ephemyral-workspace-")
+	if err != nil {
+		return nil, err
+	}
+	w := &workspace{project: project, changed: map[string][]byte{}, stored: map[string]GeneratedCommand{}, cleanup: func() error { return os.RemoveAll(parent) }}
+
+	if mode == WorkspaceWorktree {
+		err = w.addWorktree(ctx, filepath.Join(parent, "worktree"))
+	} else {
+		w.dir = filepath.Join(parent, filepath.Base(project))
+		err = copyTree(ctx, project, w.dir)
+	}
+	if err != nil {
+		w.remove()
+		return nil, fmt.Errorf("creating %s workspace: %v", mode, err)
+	}
+	activeWorkspacesMu.Lock()
+	activeWorkspaces[w.dir] = w
+	activeWorkspacesMu.Unlock()
+	return w, nil
+}
+
+// addWorktree checks out HEAD of the repository holding the project into
+// dir and applies the uncommitted changes of the working tree, so that the
+// worktree matches the project except for ignored files.
+func (w *workspace) addWorktree(ctx context.Context, dir string) error {
+	top, err := git(ctx, w.project, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	top = strings.TrimSpace(top)
+	if _, err := git(ctx, top, "worktree", "add", "--detach", dir, "HEAD"); err != nil {
+		return err
+	}
+	removeDir := w.cleanup
+	w.cleanup = func() error {
+		_, err := git(context.Background(), top, "worktree", "remove", "--force", dir)
+		if rmErr := removeDir(); err == nil {
+			err = rmErr
+		}
+		return err
+	}
+
+	rel, err := filepath.Rel(top, w.project)
+	if err != nil {
+		return err
+	}
+	w.dir = filepath.Join(dir, rel)
+
+	modified, err := git(ctx, top, "ls-files", "-z", "--modified", "--others", "--exclude-standard")
+	if err != nil {
+		return err
+	}
+	for _, name := range splitNull(modified) {
+		if err := copyFile(filepath.Join(top, name), filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	deleted, err := git(ctx, top, "ls-files", "-z", "--deleted")
+	if err != nil {
+		return err
+	}
+	for _, name := range splitNull(deleted) {
+		os.Remove(filepath.Join(dir, name))
+	}
+
+	// The project file may be ignored, but the commands are read from it.
+	err = copyFile(filepath.Join(w.project, ".ephemyral"), filepath.Join(w.dir, ".ephemyral"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// path returns where projectPath is in the scratch copy.
+func (w *workspace) path(projectPath string) (string, error) {
+	abs, err := filepath.Abs(projectPath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(w.project, abs)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%s is outside the project %s", projectPath, w.project)
+	}
+	return filepath.Join(w.dir, rel), nil
+}
+
+// write writes data to projectPath in the scratch copy and remembers it for
+// commit.
+func (w *workspace) write(projectPath string, data []byte) error {
+	path, err := w.path(projectPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// A copied symlink may point into the project; commit follows it there.
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return err
+	}
+	abs, _ := filepath.Abs(projectPath)
+	w.changed[abs] = data
+	return nil
+}
+
+// commit copies the written files back to the project and stores the
+// commands generated in the copy in its .ephemyral file. Other changes to the
+// .ephemyral file of the copy, such as those of a build or test command, are
+// discarded.
+func (w *workspace) commit() error {
+	for path, data := range w.changed {
+		if err := writeFileAtomic(path, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	ephemyralFileMu.Lock()
+	stored := w.stored
+	w.stored = map[string]GeneratedCommand{}
+	ephemyralFileMu.Unlock()
+	for name, generated := range stored {
+		if err := updateEphemyralFile(w.project, name, generated); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes the scratch copy.
+func (w *workspace) remove() {
+	activeWorkspacesMu.Lock()
+	delete(activeWorkspaces, w.dir)
+	activeWorkspacesMu.Unlock()
+	if err := w.cleanup(); err != nil {
+		fmt.Println("Error removing workspace:", err)
+	}
+}
+
+// copyTree copies the directory src to dst, which must not exist. GNU cp is
+// used when available, so that file systems with reflinks copy on write.
+func copyTree(ctx context.Context, src, dst string) error {
+	if _, err := exec.LookPath("cp"); err == nil {
+		if err := exec.CommandContext(ctx, "cp", "-a", "--reflink=auto", src, dst).Run(); err == nil {
+			return nil
+		}
+		os.RemoveAll(dst)
+	}
+
+	return filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		switch {
+		case entry.IsDir():
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			return os.MkdirAll(target, info.Mode().Perm())
+		case entry.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case entry.Type().IsRegular():
+			return copyFile(path, target)
+		default:
+			return nil
+		}
+	})
+}
+
+// copyFile copies the regular file src to dst, keeping its permissions.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// git runs git in dir and returns its output.
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+func splitNull(s string) []string {
+	var result []string
+	for _, name := range strings.Split(s, "\x00") {
+		if name != "" {
+			result = append(result, name)
+		}
+	}
+	return result
+}
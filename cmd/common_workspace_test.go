@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ephemyral/pkg/llmtest"
+
+	"github.com/google/uuid"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRefactorVerifiesInScratchCopy(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Reply("```go\npackage main\n\n// refactored\n```"))
+	defer server.Close()
+	configureTestLLM(t, server)
+	viper.Set("workspace", WorkspaceCopy)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	require.NoError(t, os.WriteFile(path, []byte("package main\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("test-command: touch artefact && grep -q refactored main.go\n"), 0644))
+
+	executeRefactorWithRetries(context.Background(), path, "add a comment", "", uuid.New(), 1, time.Millisecond, false, false, true, false)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "package main\n\n// refactored\n", string(content))
+	require.NoFileExists(t, filepath.Join(dir, "artefact"))
+}
+
+func TestRefactorInScratchCopyWritesTargetOutsideProject(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Reply("```go\npackage main\n\n// refactored\n```"))
+	defer server.Close()
+	configureTestLLM(t, server)
+	viper.Set("workspace", WorkspaceCopy)
+
+	dir, target := t.TempDir(), t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	require.NoError(t, os.WriteFile(path, []byte("package main\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("test-command: \"true\"\n"), 0644))
+
+	executeRefactorWithRetries(context.Background(), path, "add a comment", target, uuid.New(), 1, time.Millisecond, false, false, true, false)
+
+	content, err := os.ReadFile(filepath.Join(target, "main.go"))
+	require.NoError(t, err)
+	require.Equal(t, "package main\n\n// refactored\n", string(content))
+	content, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "package main\n", string(content))
+}
+
+func TestRefactorDiscardsFailedScratchCopy(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Replies("```go\npackage main\n\n// refactored\n```", "NONE", "```go\npackage main\n\n// refactored\n```", "NONE"))
+	defer server.Close()
+	configureTestLLM(t, server)
+	viper.Set("workspace", WorkspaceCopy)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.go")
+	require.NoError(t, os.WriteFile(path, []byte("package main\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("test-command: touch artefact && false\n"), 0644))
+
+	executeRefactorWithRetries(context.Background(), path, "add a comment", "", uuid.New(), 1, time.Millisecond, false, false, true, false)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "package main\n", string(content))
+	require.NoFileExists(t, filepath.Join(dir, "artefact"))
+}
+
+func TestWorktreeIncludesUncommittedChanges(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	for _, args := range [][]string{{"init", "-q"}, {"config", "user.email", "test@example.com"}, {"config", "user.name", "test"}} {
+		_, err := git(context.Background(), dir, args...)
+		require.NoError(t, err)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "committed"), []byte("old"), 0644))
+	_, err := git(context.Background(), dir, "add", ".")
+	require.NoError(t, err)
+	_, err = git(context.Background(), dir, "commit", "-qm", "initial")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "committed"), []byte("new"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "untracked"), []byte("untracked"), 0644))
+
+	w, err := newWorkspace(context.Background(), WorkspaceWorktree, dir)
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(w.dir, "committed"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(content))
+	require.FileExists(t, filepath.Join(w.dir, "untracked"))
+
+	require.NoError(t, w.write(filepath.Join(dir, "changed"), []byte("changed")))
+	require.NoFileExists(t, filepath.Join(dir, "changed"))
+	require.NoError(t, w.commit())
+	require.FileExists(t, filepath.Join(dir, "changed"))
+
+	w.remove()
+	require.NoDirExists(t, w.dir)
+	worktrees, err := git(context.Background(), dir, "worktree", "list")
+	require.NoError(t, err)
+	require.NotContains(t, worktrees, "ephemyral-workspace-")
+}
+
+func TestWorkspaceCommitsOnlyStoredCommands(t *testing.T) {
+	t.Setenv("EPHEMYRAL_HOME", t.TempDir())
+	viper.Set("approve", ApproveNew)
+	defer viper.Reset()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".ephemyral"), []byte("version: 2\ncommands:\n  test:\n    command: go test ./...\n"), 0644))
+	w, err := newWorkspace(context.Background(), WorkspaceCopy, dir)
+	require.NoError(t, err)
+	defer w.remove()
+
+	require.NoError(t, updateEphemyralFile(w.dir, "build", GeneratedCommand{Command: "go build ./...", WorkingDir: "."}))
+	// A command run in the copy rewrites its .ephemyral file.
+	ephemyral, err := readEphemyralFile(w.dir)
+	require.NoError(t, err)
+	ephemyral.Commands["test"] = CommandSettings{Command: "true"}
+	require.NoError(t, writeEphemyralFile(w.dir, ephemyral))
+
+	setApprovalInput(t, "y\n")
+	require.NoError(t, approveCommand(w.dir, w.dir, "go build ./...", "test"))
+	require.NoError(t, w.commit())
+
+	ephemyral, err = readEphemyralFile(dir)
+	require.NoError(t, err)
+	require.Equal(t, "go build ./...", ephemyral.command("build"))
+	require.Equal(t, "go test ./...", ephemyral.command("test"))
+
+	// The approval given in the copy holds for the project.
+	setApprovalInput(t, "")
+	require.NoError(t, approveCommand(dir, dir, "go build ./...", "test"))
+	approvals, err := readApprovals()
+	require.NoError(t, err)
+	require.Len(t, approvals, 1)
+	require.Contains(t, approvals, dir)
+}
@@ -1,3 +1,4 @@
+//go:build !lint
 // +build !lint
 
 package cmd
@@ -6,8 +7,26 @@ const (
 	DefaultRefactorPrompt = "Optimize the code for better performance and readability."
 	RefactorPromptPattern = "Analyze the following code and return only the refactored or optimized code based on this instruction: '%s'. " +
 		"Provide the refactored version only, without extra text or unchanged code.\n\n```%s```"
-	BuildCommandPrompt = "Provide the simplest command line required to build the listed files. The command must be in a single line and contain no extra text or commentary:\n"
-	TestCommandPrompt  = "Provide the simplest command line required to test the listed files. The command must be in a single line and contain no extra text or commentary:\n"
-	LintCommandPrompt  = "Provide the simplest command line required to lint the listed files. The command must be in a single line and contain no extra text or commentary:\n"
-	DocsCommandPrompt  = "Provide the simplest command line required to generate documentation for the listed files. The command must be in a single line and contain no extra text or commentary:\n"
+	RefactorChunkPromptPattern = "The file to refactor is too large for one request and is sent in %d parts. This is part %d. " +
+		"Analyze it and return only the refactored or optimized code for this part based on this instruction: '%s'. " +
+		"Provide the refactored version of this part only, without extra text, so that the parts can be joined in order.\n\n```%s```"
+	BuildCommandPrompt        = "Provide the simplest command line required to build the listed files.\n"
+	TestCommandPrompt         = "Provide the simplest command line required to test the listed files.\n"
+	LintCommandPrompt         = "Provide the simplest command line required to lint the listed files.\n"
+	DocsCommandPrompt         = "Provide the simplest command line required to generate documentation for the listed files.\n"
+	NamedCommandPrompt        = "Provide the simplest command line that does the following for the listed files: %s\n"
+	DefaultNamedCommandPrompt = "Provide the simplest command line required to run the %q task of the listed files.\n"
+	CommandResponseFormat     = "Respond with only a JSON object with these fields and no extra text or commentary: " +
+		"\"command\", the command as a single shell line; \"working_dir\", the directory to run it in relative to the project root (\".\" for the root); " +
+		"\"prerequisites\", the programs that must be installed for it to work; \"rationale\", one sentence on why this command was chosen. Files:\n"
+	AutomodePrompt = "You are working on the project in the current directory. Your goal: %s\n" +
+		"Use the tools to inspect, change and test the project. All paths are relative to the project root and must stay inside it. " +
+		"When you are done, reply without calling a tool; the test command will then be run and you will get its output if it fails."
+	AutomodeTestsFailedPrompt = "The test command failed:\n%s\nFix the problem."
+	SchemaViolationPrompt     = "Your previous answer was rejected: %v. Respond again with only the JSON object described before."
+	DependencyCommandPrompt   = "The command `%s` failed.\n%s\nEnvironment:\n%s\n" +
+		"If the failure is caused by missing programs or libraries, reply with the simplest single-line command that installs them in this environment, " +
+		"using '&&' between multiple commands and flags like '-y' for automatic confirmation. " +
+		"If it has another cause, such as a compile error or a failing test, reply with only NONE. Reply with no comments, explanations, or code blocks.\n"
+	ShellPolicyPrompt = "Your previous command was rejected by the shell safety policy: %v. Suggest a different command that complies, in the same format as before."
 )
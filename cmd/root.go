@@ -4,11 +4,15 @@ package cmd
 
 import (
 	"bufio"
+	"context"
+	gpt4client "ephemyral/pkg"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/cobra/doc"
@@ -33,16 +37,50 @@ var (
          ░░░░░                                           ░░░░░░                             
 
 Ephemyral is an AI-powered CLI application designed to streamline and optimize various software development tasks with the help of machine learning. By leveraging large language models, Ephemyral provides a set of robust commands that simplify building, testing, and managing development workflows. This tool is tailored for software engineers, data scientists, and anyone managing software projects.`,
+		PersistentPreRunE: configureLLM,
 	}
 )
 
 func Execute() {
-	cobra.CheckErr(rootCmd.Execute())
+	// Cancel the command context on Ctrl-C so running commands can clean up.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	cobra.CheckErr(rootCmd.ExecuteContext(ctx))
 }
 
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.ephemyral.yaml)")
+	rootCmd.PersistentFlags().Bool("stream", false, "Print LLM output live as it is generated")
+	rootCmd.PersistentFlags().Int("llm-retries", gpt4client.DefaultRetryPolicy.MaxRetries, "Maximum retries for rate-limited or failed LLM requests")
+	rootCmd.PersistentFlags().String("model", "", "LLM model to use (default depends on the provider)")
+	rootCmd.PersistentFlags().Float64("temperature", 0, "Sampling temperature for the LLM (default depends on the provider)")
+	rootCmd.PersistentFlags().Int("max-tokens", 0, "Maximum number of tokens the LLM may generate per request")
+	rootCmd.PersistentFlags().Int("seed", 0, "Seed for reproducible LLM sampling, where supported")
+	rootCmd.PersistentFlags().Bool("show-prompt", false, "Print the final prompt and its token count instead of calling the LLM")
+	rootCmd.PersistentFlags().Float64("max-cost", 0, "Abort once the estimated LLM cost of this run reaches this many US dollars (0 for no limit)")
+	rootCmd.PersistentFlags().Int("max-tokens-total", 0, "Abort once this run has used this many LLM tokens (0 for no limit)")
+	rootCmd.PersistentFlags().Bool("offline", false, "Serve LLM responses from the cache only and fail when a response is not cached")
+	rootCmd.PersistentFlags().Bool("no-cache", false, "Neither read nor write the LLM response cache")
+	rootCmd.PersistentFlags().String("api-url", "", "Chat completions endpoint of the LLM provider (default depends on the provider)")
+	rootCmd.PersistentFlags().String("approve", "", "Ask before running shell commands: always, new (commands not approved before) or never (default never)")
+	rootCmd.PersistentFlags().Bool("dry-run", false, "Print the shell commands that would run, with their origin and working directory, without executing them")
+	rootCmd.PersistentFlags().Bool("allow-install", false, "Allow shell commands that install packages for the system or the user")
+	rootCmd.PersistentFlags().Bool("show-env", false, "Print the environment variables each shell command will see")
+	rootCmd.PersistentFlags().String("executor", "", "How to run shell commands: local, or sandbox to isolate them from the network and from files outside the project (Linux only)")
+	rootCmd.PersistentFlags().String("workspace", "", "Where refactor verifies changes: in-place, copy (a scratch copy of the project) or worktree (a git worktree); only verified files are copied back")
+	bindRootFlags()
+}
+
+// bindRootFlags binds the persistent flags to their viper keys and sets the
+// defaults of settings that have no flag.
+func bindRootFlags() {
+	for _, name := range []string{"stream", "llm-retries", "model", "temperature", "max-tokens", "seed", "show-prompt", "max-cost", "max-tokens-total", "offline", "no-cache", "api-url", "approve", "dry-run", "allow-install", "show-env", "executor", "workspace"} {
+		viper.BindPFlag(name, rootCmd.PersistentFlags().Lookup(name))
+	}
+	viper.SetDefault("llm-retry-base-delay", gpt4client.DefaultRetryPolicy.BaseDelay)
+	viper.SetDefault("llm-retry-max-delay", gpt4client.DefaultRetryPolicy.MaxDelay)
+	viper.SetDefault("cache-ttl", gpt4client.DefaultCacheTTL)
 }
 
 func initConfig() {
@@ -0,0 +1,262 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	cacheEnv        = "EPHEMYRAL_CACHE_DIR"
+	DefaultCacheTTL = 24 * time.Hour
+)
+
+// ErrOffline is returned in offline mode when a request has no cached
+// response.
+var ErrOffline = errors.New("offline: no cached response for this request")
+
+// CacheConfig controls the on-disk response cache. Responses older than TTL
+// are ignored; a zero TTL keeps them forever. In Offline mode requests are
+// served from the cache only.
+type CacheConfig struct {
+	Disabled bool
+	TTL      time.Duration
+	Offline  bool
+}
+
+// cacheEntry is a cached response as stored on disk.
+type cacheEntry struct {
+	Key       string     `json:"key"`
+	Provider  string     `json:"provider"`
+	Model     string     `json:"model"`
+	Created   time.Time  `json:"created"`
+	Content   string     `json:"content"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	Usage     Usage      `json:"usage"`
+}
+
+// CacheStats describes the contents of the response cache.
+type CacheStats struct {
+	Dir     string
+	Entries int
+	Expired int
+	Bytes   int64
+	Oldest  time.Time
+	Newest  time.Time
+}
+
+var cacheConfig = CacheConfig{TTL: DefaultCacheTTL}
+
+// SetCache replaces the cache configuration.
+func SetCache(cfg CacheConfig) {
+	cacheConfig = cfg
+}
+
+// cacheDir returns the directory holding cached responses. It can be
+// overridden with the EPHEMYRAL_CACHE_DIR environment variable.
+func cacheDir() (string, error) {
+	if dir := os.Getenv(cacheEnv); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ephemyral", "responses"), nil
+}
+
+// cacheKey hashes everything that determines the reply to req.
+func cacheKey(providerName string, req Request) string {
+	messages := make([]Message, len(req.Messages))
+	for i, m := range req.Messages {
+		messages[i] = Message{Role: m.Role, Content: m.Content, ToolCalls: m.ToolCalls, ToolCallID: m.ToolCallID}
+	}
+
+	data, _ := json.Marshal(struct {
+		Provider string    `json:"provider"`
+		Model    string    `json:"model"`
+		Params   Params    `json:"params"`
+		Schema   *Schema   `json:"schema,omitempty"`
+		Tools    []Tool    `json:"tools,omitempty"`
+		System   string    `json:"system"`
+		Messages []Message `json:"messages"`
+	}{providerName, req.Model, req.Params, req.Schema, req.Tools, req.System, messages})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func cacheEntryPath(key string) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, key[:2], key+".json"), nil
+}
+
+func (e *cacheEntry) expired(now time.Time) bool {
+	return cacheConfig.TTL > 0 && now.Sub(e.Created) > cacheConfig.TTL
+}
+
+// cachedResponse returns the cached reply to req, if there is a fresh one.
+func cachedResponse(req Request) (Response, bool) {
+	if cacheConfig.Disabled {
+		return Response{}, false
+	}
+
+	key := cacheKey(provider.Name(), req)
+	path, err := cacheEntryPath(key)
+	if err != nil {
+		return Response{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Response{}, false
+	}
+
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Key != key || entry.expired(time.Now()) {
+		return Response{}, false
+	}
+	debugLog("Serving cached response %s", key)
+	return Response{Content: entry.Content, Model: entry.Model, Usage: entry.Usage, ToolCalls: entry.ToolCalls}, true
+}
+
+// storeResponse caches the reply to req.
+func storeResponse(req Request, resp Response) {
+	if cacheConfig.Disabled {
+		return
+	}
+
+	key := cacheKey(provider.Name(), req)
+	entry := cacheEntry{
+		Key:       key,
+		Provider:  provider.Name(),
+		Model:     req.Model,
+		Created:   time.Now(),
+		Content:   resp.Content,
+		ToolCalls: resp.ToolCalls,
+		Usage:     resp.Usage,
+	}
+	if err := writeCacheEntry(entry); err != nil {
+		debugLog("Error caching response: %v", err)
+	}
+}
+
+func writeCacheEntry(entry cacheEntry) error {
+	path, err := cacheEntryPath(entry.Key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that concurrent readers never see a
+	// partial entry.
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// walkCache calls fn for every cache entry file.
+func walkCache(fn func(path string, info os.FileInfo) error) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+		return fn(path, info)
+	})
+	return dir, err
+}
+
+// GetCacheStats reports the number, size and age of cached responses.
+func GetCacheStats() (CacheStats, error) {
+	var stats CacheStats
+	now := time.Now()
+	dir, err := walkCache(func(path string, info os.FileInfo) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var entry cacheEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		stats.Entries++
+		stats.Bytes += info.Size()
+		if entry.expired(now) {
+			stats.Expired++
+		}
+		if stats.Oldest.IsZero() || entry.Created.Before(stats.Oldest) {
+			stats.Oldest = entry.Created
+		}
+		if entry.Created.After(stats.Newest) {
+			stats.Newest = entry.Created
+		}
+		return nil
+	})
+	stats.Dir = dir
+	return stats, err
+}
+
+// ClearCache removes cached responses and returns how many were removed. With
+// expiredOnly set, only responses older than the TTL are removed.
+func ClearCache(expiredOnly bool) (int, error) {
+	removed := 0
+	now := time.Now()
+	_, err := walkCache(func(path string, info os.FileInfo) error {
+		if expiredOnly {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			var entry cacheEntry
+			if json.Unmarshal(data, &entry) == nil && !entry.expired(now) {
+				return nil
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
@@ -0,0 +1,43 @@
+package gpt4client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponsesAreServedFromCache(t *testing.T) {
+	t.Setenv(homeEnv, t.TempDir())
+	t.Setenv(cacheEnv, t.TempDir())
+	fake := &usageProvider{}
+	SetProvider(fake, "")
+	defer SetProvider(newOpenAIProvider(ProviderConfig{}), "")
+	defer SetCache(CacheConfig{TTL: DefaultCacheTTL})
+
+	SetCache(CacheConfig{TTL: time.Hour})
+	_, err := GetResponse(context.Background(), "build", "p", uuid.New())
+	require.NoError(t, err)
+	reply, err := GetResponse(context.Background(), "build", "p", uuid.New())
+	require.NoError(t, err)
+	require.Equal(t, "ok", reply)
+	require.Equal(t, 1, fake.calls)
+
+	SetCache(CacheConfig{TTL: time.Hour, Offline: true})
+	_, err = GetResponse(context.Background(), "build", "p", uuid.New())
+	require.NoError(t, err)
+	_, err = GetResponse(context.Background(), "build", "other", uuid.New())
+	require.True(t, errors.Is(err, ErrOffline))
+	require.Equal(t, 1, fake.calls)
+
+	stats, err := GetCacheStats()
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Entries)
+
+	removed, err := ClearCache(false)
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+}
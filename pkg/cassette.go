@@ -0,0 +1,223 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	cassetteEnv      = "EPHEMYRAL_CASSETTE"
+	cassetteFileEnv  = "EPHEMYRAL_CASSETTE_FILE"
+	cassetteRecord   = "record"
+	cassetteReplay   = "replay"
+	defaultCassette  = "ephemyral.cassette.json"
+	cassetteFileMode = 0644
+)
+
+// ErrCassetteMiss is returned in replay mode for a request that was never
+// recorded.
+var ErrCassetteMiss = errors.New("no recorded response for request")
+
+// Interaction is one recorded request and its response. Headers other than
+// the content type are not recorded, so API keys never end up in fixtures.
+type Interaction struct {
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+		Body   string `json:"body"`
+	} `json:"request"`
+	Response struct {
+		Status      int    `json:"status"`
+		ContentType string `json:"content_type,omitempty"`
+		Body        string `json:"body"`
+	} `json:"response"`
+}
+
+// Cassette records provider traffic to a fixture file or replays it from
+// one. It is an http.RoundTripper.
+type Cassette struct {
+	path         string
+	mode         string
+	next         http.RoundTripper
+	mu           sync.Mutex
+	interactions []Interaction
+	used         []bool
+}
+
+var (
+	transport   http.RoundTripper
+	cassettes   = map[string]*Cassette{}
+	cassettesMu sync.Mutex
+)
+
+// SetTransport replaces the HTTP transport used to reach providers. A nil
+// transport restores the default.
+func SetTransport(rt http.RoundTripper) {
+	transport = rt
+}
+
+// NewCassette opens the fixture at path in mode "record" or "replay". In
+// record mode requests are sent through next and appended to the fixture;
+// in replay mode they are answered from it without touching the network.
+func NewCassette(path, mode string, next http.RoundTripper) (*Cassette, error) {
+	if mode != cassetteRecord && mode != cassetteReplay {
+		return nil, fmt.Errorf("unknown cassette mode %q, expected %s or %s", mode, cassetteRecord, cassetteReplay)
+	}
+	c := &Cassette{path: path, mode: mode, next: next}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && mode == cassetteRecord {
+		return c, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cassette: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.interactions); err != nil {
+		return nil, fmt.Errorf("cassette %s: %w", path, err)
+	}
+	c.used = make([]bool, len(c.interactions))
+	return c, nil
+}
+
+// cassetteFromEnv returns the cassette selected by EPHEMYRAL_CASSETTE and
+// EPHEMYRAL_CASSETTE_FILE, or nil when none is.
+func cassetteFromEnv(next http.RoundTripper) (*Cassette, error) {
+	mode := os.Getenv(cassetteEnv)
+	if mode == "" {
+		return nil, nil
+	}
+	path := firstNonEmpty(os.Getenv(cassetteFileEnv), defaultCassette)
+
+	cassettesMu.Lock()
+	defer cassettesMu.Unlock()
+	key := mode + ":" + path
+	if c, ok := cassettes[key]; ok {
+		return c, nil
+	}
+	c, err := NewCassette(path, mode, next)
+	if err != nil {
+		return nil, err
+	}
+	cassettes[key] = c
+	return c, nil
+}
+
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if c.mode == cassetteReplay {
+		return c.replay(req, string(body))
+	}
+	return c.record(req, string(body))
+}
+
+// replay answers req with the first unused matching interaction, or with the
+// last matching one when all of them have been used. Only the path of the URL
+// is compared, so fixtures recorded against one server replay against any
+// other.
+func (c *Cassette) replay(req *http.Request, body string) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	match := -1
+	for i, in := range c.interactions {
+		if in.Request.Method != req.Method || urlPath(in.Request.URL) != req.URL.Path || in.Request.Body != body {
+			continue
+		}
+		match = i
+		if !c.used[i] {
+			break
+		}
+	}
+	if match < 0 {
+		return nil, fmt.Errorf("cassette %s: %w: %s %s", c.path, ErrCassetteMiss, req.Method, req.URL)
+	}
+	c.used[match] = true
+
+	in := c.interactions[match]
+	header := http.Header{}
+	if in.Response.ContentType != "" {
+		header.Set("Content-Type", in.Response.ContentType)
+	}
+	return &http.Response{
+		Status:        http.StatusText(in.Response.Status),
+		StatusCode:    in.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader([]byte(in.Response.Body))),
+		ContentLength: int64(len(in.Response.Body)),
+		Request:       req,
+	}, nil
+}
+
+// record sends req and stores it together with the complete response.
+func (c *Cassette) record(req *http.Request, body string) (*http.Response, error) {
+	resp, err := c.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	var in Interaction
+	in.Request.Method = req.Method
+	in.Request.URL = req.URL.String()
+	in.Request.Body = body
+	in.Response.Status = resp.StatusCode
+	in.Response.ContentType = resp.Header.Get("Content-Type")
+	in.Response.Body = string(respBody)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interactions = append(c.interactions, in)
+	c.used = append(c.used, true)
+	if err := c.save(); err != nil {
+		debugLog("Error saving cassette: %v", err)
+	}
+	return resp, nil
+}
+
+func urlPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Path
+}
+
+func (c *Cassette) save() error {
+	data, err := json.MarshalIndent(c.interactions, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(c.path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(c.path, data, cassetteFileMode)
+}
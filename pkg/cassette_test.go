@@ -0,0 +1,38 @@
+package gpt4client
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"ephemyral/pkg/llmtest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCassetteRecordsAndReplays(t *testing.T) {
+	server := llmtest.NewServer(llmtest.Reply("recorded"))
+	t.Setenv("TEST_OPENAI_KEY", "secret-key")
+	t.Setenv(cassetteFileEnv, filepath.Join(t.TempDir(), "fixture.json"))
+
+	p, err := NewProvider(ProviderConfig{APIURL: server.URL(), APIKeyEnv: "TEST_OPENAI_KEY"})
+	require.NoError(t, err)
+	req := Request{Model: "m", Messages: []Message{{Role: roleUser, Content: "hello"}}}
+
+	t.Setenv(cassetteEnv, cassetteRecord)
+	resp, err := p.Complete(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, "recorded", resp.Content)
+	server.Close()
+
+	t.Setenv(cassetteEnv, cassetteReplay)
+	resp, err = p.Complete(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, "recorded", resp.Content)
+	require.Len(t, server.Requests(), 1)
+
+	req.Messages[0].Content = "something else"
+	_, err = p.Complete(context.Background(), req)
+	require.True(t, errors.Is(err, ErrCassetteMiss))
+}
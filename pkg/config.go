@@ -0,0 +1,110 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Params are the generation parameters sent with a request. Nil and zero
+// values leave the provider default in place.
+type Params struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   int      `json:"max_tokens,omitempty"`
+	Seed        *int     `json:"seed,omitempty"`
+}
+
+func (p Params) String() string {
+	var parts []string
+	if p.Temperature != nil {
+		parts = append(parts, fmt.Sprintf("temperature=%g", *p.Temperature))
+	}
+	if p.MaxTokens > 0 {
+		parts = append(parts, fmt.Sprintf("max-tokens=%d", p.MaxTokens))
+	}
+	if p.Seed != nil {
+		parts = append(parts, fmt.Sprintf("seed=%d", *p.Seed))
+	}
+	if len(parts) == 0 {
+		return "defaults"
+	}
+	return strings.Join(parts, " ")
+}
+
+// Config is the complete client configuration.
+type Config struct {
+	ProviderConfig
+	SystemPrompt   string
+	Params         Params
+	IdleTimeout    time.Duration
+	Routes         map[string]Route
+	FallbackModel  string
+	ContextWindows map[string]int
+	Prices         map[string]Price
+}
+
+// RequestMeta records the settings a stored reply was generated with, so that
+// results can be reproduced.
+type RequestMeta struct {
+	Operation string    `json:"operation,omitempty"`
+	Provider  string    `json:"provider"`
+	Model     string    `json:"model"`
+	Params    Params    `json:"params"`
+	Time      time.Time `json:"time"`
+}
+
+var (
+	provider Provider = newOpenAIProvider(ProviderConfig{})
+	settings Config
+)
+
+// SetProvider replaces the provider used by GetGPT4ResponseWithPrompt. An
+// empty model selects the provider default.
+func SetProvider(p Provider, model string) {
+	provider = p
+	settings.Model = model
+}
+
+// Configure builds the provider described by cfg and makes cfg the active
+// configuration.
+func Configure(cfg Config) error {
+	p, err := NewProvider(cfg.ProviderConfig)
+	if err != nil {
+		return err
+	}
+	provider = p
+	settings = cfg
+	return nil
+}
+
+// activeModel returns the configured model or the provider default.
+func activeModel() string {
+	if settings.Model != "" {
+		return settings.Model
+	}
+	return provider.DefaultModel()
+}
+
+func systemPrompt() string {
+	return firstNonEmpty(settings.SystemPrompt, roleSysContent)
+}
+
+func idleTimeout() time.Duration {
+	if settings.IdleTimeout > 0 {
+		return settings.IdleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+func newRequestMeta(operation string, req Request) *RequestMeta {
+	return &RequestMeta{
+		Operation: operation,
+		Provider:  provider.Name(),
+		Model:     req.Model,
+		Params:    req.Params,
+		Time:      time.Now(),
+	}
+}
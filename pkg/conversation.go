@@ -0,0 +1,165 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	homeEnv            = "EPHEMYRAL_HOME"
+	conversationsDir   = "conversations"
+	maxHistoryMessages = 20
+)
+
+// Conversation is the stored history of a single conversation ID.
+type Conversation struct {
+	ID        uuid.UUID `json:"id"`
+	Messages  []Message `json:"messages"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var (
+	conversations   = map[uuid.UUID]*Conversation{}
+	conversationsMu sync.Mutex
+)
+
+// stateDir returns the directory holding ephemyral's persistent state. It can
+// be overridden with the EPHEMYRAL_HOME environment variable.
+func stateDir() (string, error) {
+	if dir := os.Getenv(homeEnv); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ephemyral"), nil
+}
+
+// StateDir returns the directory holding ephemyral's persistent state, such
+// as conversations and logs.
+func StateDir() (string, error) {
+	return stateDir()
+}
+
+func conversationPath(id uuid.UUID) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, conversationsDir, id.String()+".json"), nil
+}
+
+// LoadConversation returns the stored conversation for id. The error wraps
+// os.ErrNotExist when no such conversation has been recorded.
+func LoadConversation(id uuid.UUID) (*Conversation, error) {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+	return loadConversationLocked(id)
+}
+
+func loadConversationLocked(id uuid.UUID) (*Conversation, error) {
+	if conv, ok := conversations[id]; ok {
+		return conv, nil
+	}
+
+	path, err := conversationPath(id)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("conversation %s: %w", id, err)
+	}
+
+	var conv Conversation
+	if err := json.Unmarshal(data, &conv); err != nil {
+		return nil, fmt.Errorf("conversation %s: %w", id, err)
+	}
+	conversations[id] = &conv
+	return &conv, nil
+}
+
+// ConversationExists reports whether a conversation has been recorded for id.
+func ConversationExists(id uuid.UUID) bool {
+	_, err := LoadConversation(id)
+	return err == nil
+}
+
+// history returns the most recent turns of the conversation, starting with a
+// user turn so that every provider accepts the sequence.
+func history(id uuid.UUID) []Message {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	conv, err := loadConversationLocked(id)
+	if err != nil {
+		return nil
+	}
+
+	messages := conv.Messages
+	if len(messages) > maxHistoryMessages {
+		messages = messages[len(messages)-maxHistoryMessages:]
+	}
+	for len(messages) > 0 && messages[0].Role != roleUser {
+		messages = messages[1:]
+	}
+	sent := make([]Message, len(messages))
+	for i, m := range messages {
+		sent[i] = Message{Role: m.Role, Content: m.Content}
+	}
+	return sent
+}
+
+// appendToConversation adds messages to the conversation and persists it.
+func appendToConversation(id uuid.UUID, messages ...Message) error {
+	conversationsMu.Lock()
+	defer conversationsMu.Unlock()
+
+	conv, err := loadConversationLocked(id)
+	if errors.Is(err, os.ErrNotExist) {
+		conv = &Conversation{ID: id}
+		conversations[id] = conv
+	} else if err != nil {
+		return err
+	}
+
+	conv.Messages = append(conv.Messages, messages...)
+	conv.UpdatedAt = time.Now()
+	return saveConversation(conv)
+}
+
+func saveConversation(conv *Conversation) error {
+	path, err := conversationPath(conv.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(conv, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// RecordFeedback adds a note to the conversation, such as why the previous
+// answer failed, so that the next prompt in the same conversation sees it.
+func RecordFeedback(convID uuid.UUID, feedback string) {
+	if err := appendToConversation(convID, Message{Role: roleUser, Content: feedback}); err != nil {
+		debugLog("Error recording conversation feedback: %v", err)
+	}
+}
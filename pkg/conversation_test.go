@@ -0,0 +1,65 @@
+package gpt4client
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingProvider answers every request with a fixed reply and keeps the
+// requests it received.
+type recordingProvider struct {
+	reply    string
+	requests []Request
+}
+
+func (p *recordingProvider) Name() string         { return "recording" }
+func (p *recordingProvider) DefaultModel() string { return "test-model" }
+func (p *recordingProvider) Complete(ctx context.Context, req Request) (Response, error) {
+	p.requests = append(p.requests, req)
+	return Response{Content: p.reply, Model: req.Model}, nil
+}
+
+func TestConversationHistoryIsSent(t *testing.T) {
+	t.Setenv(homeEnv, t.TempDir())
+	t.Setenv(cacheEnv, t.TempDir())
+	fake := &recordingProvider{reply: "ok"}
+	SetProvider(fake, "")
+
+	convID := uuid.New()
+	_, err := GetGPT4ResponseWithPrompt(context.Background(), "first", convID)
+	require.NoError(t, err)
+	RecordFeedback(convID, "that failed")
+	_, err = GetGPT4ResponseWithPrompt(context.Background(), "second", convID)
+	require.NoError(t, err)
+
+	last := fake.requests[len(fake.requests)-1]
+	require.Equal(t, []Message{
+		{Role: roleUser, Content: "first"},
+		{Role: roleAssistant, Content: "ok"},
+		{Role: roleUser, Content: "that failed"},
+		{Role: roleUser, Content: "second"},
+	}, last.Messages)
+}
+
+func TestConversationPersistsAndTrims(t *testing.T) {
+	t.Setenv(homeEnv, t.TempDir())
+	t.Setenv(cacheEnv, t.TempDir())
+	convID := uuid.New()
+	for i := 0; i < maxHistoryMessages; i++ {
+		require.NoError(t, appendToConversation(convID,
+			Message{Role: roleUser, Content: fmt.Sprint(i)},
+			Message{Role: roleAssistant, Content: "reply"}))
+	}
+
+	delete(conversations, convID)
+	require.True(t, ConversationExists(convID))
+	require.False(t, ConversationExists(uuid.New()))
+
+	messages := history(convID)
+	require.Len(t, messages, maxHistoryMessages)
+	require.Equal(t, roleUser, messages[0].Role)
+}
@@ -0,0 +1,120 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error kinds returned by providers. Use errors.Is to test for them.
+var (
+	ErrAuth          = errors.New("authentication failed")
+	ErrQuota         = errors.New("quota exceeded")
+	ErrRateLimit     = errors.New("rate limited")
+	ErrContextLength = errors.New("context length exceeded")
+	ErrServer        = errors.New("provider server error")
+	ErrUnavailable   = errors.New("model unavailable")
+)
+
+// APIError is an error reported by a provider API.
+type APIError struct {
+	Kind       error
+	StatusCode int
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	kind := "API Error"
+	if e.Kind != nil {
+		kind = "API Error (" + e.Kind.Error() + ")"
+	}
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s: HTTP %d: %s", kind, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", kind, e.Message)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Kind
+}
+
+// Retryable reports whether the request may succeed when sent again.
+func (e *APIError) Retryable() bool {
+	return e.Kind == ErrRateLimit || e.Kind == ErrServer
+}
+
+// newAPIError classifies an error response. code is the provider specific
+// error type or code and may be empty; header may be nil for errors reported
+// inside a stream.
+func newAPIError(statusCode int, header http.Header, code, message string) *APIError {
+	if message == "" {
+		message = http.StatusText(statusCode)
+	}
+	return &APIError{
+		Kind:       classifyError(statusCode, code, message),
+		StatusCode: statusCode,
+		Code:       code,
+		Message:    message,
+		RetryAfter: parseRetryAfter(header),
+	}
+}
+
+func classifyError(statusCode int, code, message string) error {
+	code = strings.ToLower(code)
+	lowerMessage := strings.ToLower(message)
+
+	switch {
+	case strings.Contains(code, "context_length") ||
+		strings.Contains(lowerMessage, "context length") ||
+		strings.Contains(lowerMessage, "context window") ||
+		strings.Contains(lowerMessage, "prompt is too long"):
+		return ErrContextLength
+	case code == "insufficient_quota" || statusCode == http.StatusPaymentRequired ||
+		strings.Contains(lowerMessage, "credit balance"):
+		return ErrQuota
+	case statusCode == http.StatusTooManyRequests || strings.Contains(code, "rate_limit"):
+		return ErrRateLimit
+	case code == "model_not_found" || code == "not_found_error" ||
+		(statusCode == http.StatusNotFound && strings.Contains(lowerMessage, "model")):
+		return ErrUnavailable
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden ||
+		strings.Contains(code, "authentication") || code == "invalid_api_key":
+		return ErrAuth
+	case statusCode >= 500 || strings.Contains(code, "overloaded") || code == "api_error":
+		return ErrServer
+	}
+	return nil
+}
+
+// parseRetryAfter reads the Retry-After header, in seconds or as an HTTP date,
+// and the millisecond variant some providers send.
+func parseRetryAfter(header http.Header) time.Duration {
+	if header == nil {
+		return 0
+	}
+	if ms, err := strconv.Atoi(header.Get("retry-after-ms")); err == nil && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -1,35 +1,31 @@
+//go:build !lint
 // +build !lint
 
 package gpt4client
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/fatih/color"
+	"github.com/google/uuid"
 )
 
 const (
-	apiURL         = "https://api.openai.com/v1/chat/completions"
-	model          = "gpt-4o"
 	roleSys        = "system"
 	roleUser       = "user"
+	roleAssistant  = "assistant"
 	roleSysContent = "You are writing software code."
 )
 
-var (
-	debug       bool
-	stopSpinner = make(chan bool)
-	spinnerDone sync.WaitGroup
-)
+var debug bool
 
 // SetDebug enables or disables debug output.
 func SetDebug(enabled bool) {
@@ -43,147 +39,227 @@ func debugLog(format string, v ...interface{}) {
 	}
 }
 
-// startSpinner starts a spinner in a separate goroutine.
-func startSpinner() {
-	spinnerDone.Add(1)
+// startSpinner starts a spinner in a separate goroutine and returns a function
+// that stops it and waits for the goroutine to exit.
+func startSpinner() func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
 	go func() {
-		defer spinnerDone.Done()
+		defer wg.Done()
 		spinnerChars := []string{"|", "/", "-", "\\"}
 		color := color.New(color.FgCyan).SprintFunc()
-		i := 0
-		for {
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			fmt.Printf("\r%s", color(spinnerChars[i%len(spinnerChars)]))
 			select {
-			case <-stopSpinner:
+			case <-done:
 				return
-			default:
-				fmt.Printf("\r%s", color(spinnerChars[i%len(spinnerChars)]))
-				time.Sleep(100 * time.Millisecond)
-				i++
+			case <-ticker.C:
 			}
 		}
 	}()
-}
 
-// stopSpinner stops the spinner.
-func stopSpinnerFunc() {
-	stopSpinner <- true
-	spinnerDone.Wait() // Wait for the spinner goroutine to finish
-}
-
-func getAPIKey() (string, error) {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		return "", fmt.Errorf("API key not found in environment variable 'OPENAI_API_KEY'")
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
 	}
-	return apiKey, nil
 }
 
-func preparePayload(prompt string) ([]byte, error) {
-	messages := []map[string]interface{}{
-		{"role": roleSys, "content": roleSysContent},
-		{"role": roleUser, "content": prompt},
-	}
-
-	payload := map[string]interface{}{
-		"model":    model,
-		"messages": messages,
+func createHTTPClient() (*http.Client, error) {
+	rt := transport
+	if rt == nil {
+		tlsConfig := &tls.Config{
+			MinVersion:               tls.VersionTLS12,
+			CipherSuites:             []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			PreferServerCipherSuites: true,
+		}
+		rt = &http.Transport{TLSClientConfig: tlsConfig}
 	}
 
-	return json.Marshal(payload)
-}
-
-func createHTTPClient() *http.Client {
-	tlsConfig := &tls.Config{
-		MinVersion:               tls.VersionTLS12,
-		CipherSuites:             []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
-		PreferServerCipherSuites: true,
+	cassette, err := cassetteFromEnv(rt)
+	if err != nil {
+		return nil, err
 	}
-	return &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: tlsConfig,
-		},
-		Timeout: 30 * time.Second,
+	if cassette != nil {
+		rt = cassette
 	}
+
+	// No overall Timeout: long generations are bounded by idle time instead,
+	// see idleTimeoutReader.
+	return &http.Client{Transport: rt}, nil
 }
 
-func doPostRequest(client *http.Client, payloadBytes []byte, apiKey string) (*http.Response, error) {
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(payloadBytes))
+// openPost sends payloadBytes to url with the given extra headers and returns
+// the response. The response body is cancelled when it stays idle for longer
+// than the configured idle timeout and must be closed by the caller. For a
+// streamed request the headers must arrive within the idle timeout as well; a
+// non-streamed one only sends them once the whole reply is generated.
+func openPost(ctx context.Context, url string, payloadBytes []byte, headers map[string]string, streamed bool) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payloadBytes))
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer " + apiKey)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 
-	return client.Do(req)
-}
+	debugLog("Request payload: %s", string(payloadBytes))
 
-func GetGPT4ResponseWithPrompt(prompt string, convID uuid.UUID) (string, error) {
-	apiKey, err := getAPIKey()
+	client, err := createHTTPClient()
 	if err != nil {
-		return "", err
+		cancel()
+		return nil, err
 	}
 
-	payloadBytes, err := preparePayload(prompt)
+	var headerTimer *time.Timer
+	var timedOut atomic.Bool
+	if streamed {
+		headerTimer = time.AfterFunc(idleTimeout(), func() {
+			timedOut.Store(true)
+			cancel()
+		})
+	}
+	resp, err := client.Do(req)
+	if headerTimer != nil {
+		headerTimer.Stop()
+	}
 	if err != nil {
-		return "", err
+		cancel()
+		if timedOut.Load() {
+			return nil, fmt.Errorf("%w: no response from provider for %s", ErrIdleTimeout, idleTimeout())
+		}
+		return nil, err
 	}
 
-	debugLog("Request payload: %s", string(payloadBytes))
-
-	client := createHTTPClient()
+	// Log HTTP status code
+	debugLog("HTTP Status Code: %d", resp.StatusCode)
 
-	startSpinner()
-	defer stopSpinnerFunc()
+	resp.Body = newIdleTimeoutReader(resp.Body, idleTimeout(), cancel)
+	return resp, nil
+}
 
-	resp, err := doPostRequest(client, payloadBytes, apiKey)
+// readBody reads a complete response body.
+func readBody(body io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	defer resp.Body.Close()
+	// Log full response body for debugging
+	debugLog("Response Body: %s", string(data))
 
-	// Log HTTP status code
-	debugLog("HTTP Status Code: %d", resp.StatusCode)
+	return data, nil
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+// GetGPT4ResponseWithPrompt sends prompt using the global model settings. See
+// GetResponse.
+func GetGPT4ResponseWithPrompt(ctx context.Context, prompt string, convID uuid.UUID) (string, error) {
+	return GetResponse(ctx, "", prompt, convID)
+}
+
+// GetResponse sends prompt to the configured provider together with the
+// earlier turns of the conversation convID, using the model and parameters
+// routed to operation. Both the prompt and the reply are recorded in the
+// conversation. Older turns are dropped when the history does not fit into
+// the model's context window. When the routed model fails with a context-length or
+// availability error, the request is repeated once with the fallback model.
+func GetResponse(ctx context.Context, operation, prompt string, convID uuid.UUID) (string, error) {
+	return GetStructuredResponse(ctx, operation, prompt, convID, nil)
+}
+
+// GetStructuredResponse is GetResponse for a reply in the JSON format
+// described by schema. The reply is returned as text and must still be
+// validated by the caller.
+func GetStructuredResponse(ctx context.Context, operation, prompt string, convID uuid.UUID, schema *Schema) (string, error) {
+	route := resolveRoute(operation)
+	budget, _ := Budget(operation)
+	userMessage := Message{Role: roleUser, Content: prompt}
+	req := Request{
+		Model:    route.Model,
+		System:   systemPrompt(),
+		Messages: append(fitHistory(route.Model, budget, history(convID), userMessage), userMessage),
+		Params:   route.Params,
+		Schema:   schema,
 	}
 
-	// Log full response body for debugging
-	debugLog("Response Body: %s", string(body))
+	if showPrompt {
+		printPrompt(operation, req)
+		return "", ErrPromptShown
+	}
+	checkBudget(operation, req)
 
-	var responseMap map[string]interface{}
-	if err := json.Unmarshal(body, &responseMap); err != nil {
+	resp, err := sendWithFallback(ctx, convID, operation, route, req)
+	if err != nil {
 		return "", err
 	}
 
-	return extractContentFromResponse(responseMap)
+	reply := Message{Role: roleAssistant, Content: resp.Content, Meta: newRequestMeta(operation, req)}
+	if err := appendToConversation(convID, userMessage, reply); err != nil {
+		debugLog("Error saving conversation: %v", err)
+	}
+	return resp.Content, nil
 }
 
-func extractContentFromResponse(responseMap map[string]interface{}) (string, error) {
-	// Check for errors in the API response
-	if apiErr, ok := responseMap["error"].(map[string]interface{}); ok {
-		errMsg, ok := apiErr["message"].(string)
-		if ok {
-			return "", fmt.Errorf("API Error: %s", errMsg)
-		}
+// sendWithFallback sends req and repeats it once with the fallback model of
+// route when the routed model fails with a context-length or availability
+// error.
+func sendWithFallback(ctx context.Context, convID uuid.UUID, operation string, route Route, req Request) (Response, error) {
+	resp, err := send(ctx, convID, operation, req)
+	if err != nil && route.Fallback != "" && route.Fallback != req.Model && shouldFallback(err) {
+		fmt.Printf("Model %s failed (%v), falling back to %s\n", req.Model, err, route.Fallback)
+		req.Model = route.Fallback
+		resp, err = send(ctx, convID, operation, req)
 	}
+	return resp, err
+}
 
-	choices, ok := responseMap["choices"].([]interface{})
-	if ok && len(choices) > 0 {
-		firstChoice, ok := choices[0].(map[string]interface{})
-		if ok {
-			message, ok := firstChoice["message"].(map[string]interface{})
-			if ok {
-				content, ok := message["content"].(string)
-				if ok {
-					return content, nil
-				}
-			}
+// send performs a single routed request, showing either the spinner or the
+// streamed tokens while it runs, and records its usage. Cached replies are
+// returned without contacting the provider. Replies without tools are always
+// streamed from the provider, so the idle timeout measures the gaps between
+// tokens rather than the whole generation; the tokens are only printed with
+// SetStreamOutput.
+func send(ctx context.Context, convID uuid.UUID, operation string, req Request) (Response, error) {
+	if resp, ok := cachedResponse(req); ok {
+		if streamOutput != nil {
+			fmt.Fprintln(streamOutput, resp.Content)
 		}
+		return resp, nil
+	}
+	if cacheConfig.Offline {
+		return Response{}, ErrOffline
 	}
+	if err := checkUsageLimits(); err != nil {
+		return Response{}, err
+	}
+	debugLog("Operation: %s, provider: %s, model: %s, params: %s, history: %d messages", operation, provider.Name(), req.Model, req.Params, len(req.Messages)-1)
 
-	return "", fmt.Errorf("Your current trial usage of Ephemyral may have either expired or been revoked, please reach out for an updated version or contact us.")
+	if len(req.Tools) == 0 {
+		req.OnToken = func(string) {}
+	}
+	if streamOutput != nil && req.OnToken != nil {
+		req.OnToken = func(token string) {
+			fmt.Fprint(streamOutput, token)
+		}
+		defer fmt.Fprintln(streamOutput)
+	} else {
+		stopSpinner := startSpinner()
+		defer stopSpinner()
+	}
+	resp, err := completeWithRetry(ctx, provider, req)
+	if err != nil {
+		return Response{}, err
+	}
+	recordUsage(convID, operation, req, resp)
+	storeResponse(req, resp)
+	return resp, nil
 }
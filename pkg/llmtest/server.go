@@ -0,0 +1,228 @@
+//go:build !lint
+// +build !lint
+
+// Package llmtest provides a fake OpenAI-compatible chat-completions server
+// for tests that must not reach a real provider.
+package llmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// CompletionsPath is the path the fake server answers on.
+const CompletionsPath = "/v1/chat/completions"
+
+// Message is one chat turn of a received request.
+type Message struct {
+	Role       string         `json:"role"`
+	Content    string         `json:"content"`
+	ToolCalls  []wireToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+}
+
+// Request is a chat-completions request received by the server.
+type Request struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Stream   bool      `json:"stream"`
+	Tools    []struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	} `json:"tools"`
+}
+
+// ToolCall is a tool call the server replies with. Arguments is a JSON
+// object.
+type ToolCall struct {
+	Name      string
+	Arguments string
+}
+
+// Answer is a complete reply: text, tool calls or both.
+type Answer struct {
+	Content   string
+	ToolCalls []ToolCall
+}
+
+type wireToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// Prompt returns the content of the last user message.
+func (r Request) Prompt() string {
+	for i := len(r.Messages) - 1; i >= 0; i-- {
+		if r.Messages[i].Role == "user" {
+			return r.Messages[i].Content
+		}
+	}
+	return ""
+}
+
+// Responder returns the reply to a request.
+type Responder func(req Request) string
+
+// ToolResponder returns the reply to a request that may call tools.
+type ToolResponder func(req Request) Answer
+
+// Reply always answers with content.
+func Reply(content string) Responder {
+	return func(Request) string {
+		return content
+	}
+}
+
+// Replies answers with contents in order and repeats the last one once they
+// are used up.
+func Replies(contents ...string) Responder {
+	var mu sync.Mutex
+	next := 0
+	return func(Request) string {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(contents) == 0 {
+			return ""
+		}
+		content := contents[min(next, len(contents)-1)]
+		next++
+		return content
+	}
+}
+
+// Server is a fake chat-completions server. Point a client at URL().
+type Server struct {
+	*httptest.Server
+	respond  ToolResponder
+	mu       sync.Mutex
+	requests []Request
+	calls    int
+}
+
+// NewServer starts a server that answers every request using respond. The
+// caller must Close it.
+func NewServer(respond Responder) *Server {
+	return NewToolServer(func(req Request) Answer {
+		return Answer{Content: respond(req)}
+	})
+}
+
+// NewToolServer is NewServer for replies that may call tools. Tool calls are
+// never streamed.
+func NewToolServer(respond ToolResponder) *Server {
+	s := &Server{respond: respond}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// URL returns the chat-completions endpoint of the server.
+func (s *Server) URL() string {
+	return s.Server.URL + CompletionsPath
+}
+
+// Requests returns every request received so far.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != CompletionsPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error":{"message":%q,"type":"invalid_request_error"}}`, err.Error())
+		return
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, req)
+	s.mu.Unlock()
+
+	answer := s.respond(req)
+	usage := map[string]int{
+		"prompt_tokens":     estimateTokens(req),
+		"completion_tokens": (len(answer.Content) + 3) / 4,
+	}
+	usage["total_tokens"] = usage["prompt_tokens"] + usage["completion_tokens"]
+
+	if req.Stream && len(answer.ToolCalls) == 0 {
+		writeStream(w, req.Model, answer.Content, usage)
+		return
+	}
+
+	message := Message{Role: "assistant", Content: answer.Content}
+	finishReason := "stop"
+	s.mu.Lock()
+	for _, call := range answer.ToolCalls {
+		s.calls++
+		var wire wireToolCall
+		wire.ID = fmt.Sprintf("call_%d", s.calls)
+		wire.Type = "function"
+		wire.Function.Name = call.Name
+		wire.Function.Arguments = call.Arguments
+		message.ToolCalls = append(message.ToolCalls, wire)
+		finishReason = "tool_calls"
+	}
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "chat.completion",
+		"model":  req.Model,
+		"choices": []map[string]interface{}{{
+			"index":         0,
+			"message":       message,
+			"finish_reason": finishReason,
+		}},
+		"usage": usage,
+	})
+}
+
+// writeStream sends content as server-sent events, one word per chunk.
+func writeStream(w http.ResponseWriter, model, content string, usage map[string]int) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	writeEvent := func(v interface{}) {
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+
+	for _, word := range strings.SplitAfter(content, " ") {
+		writeEvent(map[string]interface{}{
+			"object":  "chat.completion.chunk",
+			"model":   model,
+			"choices": []map[string]interface{}{{"index": 0, "delta": map[string]string{"content": word}}},
+		})
+	}
+	writeEvent(map[string]interface{}{
+		"object":  "chat.completion.chunk",
+		"model":   model,
+		"choices": []interface{}{},
+		"usage":   usage,
+	})
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func estimateTokens(req Request) int {
+	total := 0
+	for _, m := range req.Messages {
+		total += (len(m.Content)+3)/4 + 4
+	}
+	return total
+}
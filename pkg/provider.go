@@ -0,0 +1,114 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	ProviderOpenAI    = "openai"
+	ProviderAnthropic = "anthropic"
+	ProviderOllama    = "ollama"
+)
+
+// Message is a single chat turn sent to or received from a provider. Meta is
+// only set on stored assistant turns and is never sent to a provider.
+// ToolCalls is set on assistant turns that call tools and ToolCallID on the
+// tool turns answering them.
+type Message struct {
+	Role       string       `json:"role"`
+	Content    string       `json:"content"`
+	ToolCalls  []ToolCall   `json:"tool_calls,omitempty"`
+	ToolCallID string       `json:"tool_call_id,omitempty"`
+	Meta       *RequestMeta `json:"meta,omitempty"`
+}
+
+// Request is a provider-neutral chat completion request. When OnToken is set
+// the provider streams the response and calls it for every text fragment.
+// When Schema is set the reply must be a JSON document matching it. Tools are
+// the functions the model may call instead of answering.
+type Request struct {
+	Model    string
+	System   string
+	Messages []Message
+	Params   Params
+	Schema   *Schema
+	Tools    []Tool
+	OnToken  func(token string)
+}
+
+// Schema is a named JSON schema for structured replies. Providers that cannot
+// enforce a schema rely on the prompt describing the expected format.
+type Schema struct {
+	Name       string
+	Definition map[string]interface{}
+}
+
+// Response is a provider-neutral chat completion response. Usage is zero when
+// the provider did not report token usage; ToolCalls lists the tools the model
+// asked to call.
+type Response struct {
+	Content   string
+	Model     string
+	Usage     Usage
+	ToolCalls []ToolCall
+}
+
+// Usage is the number of tokens a request consumed.
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+}
+
+// Provider sends chat completion requests to an LLM backend.
+type Provider interface {
+	Name() string
+	DefaultModel() string
+	Complete(ctx context.Context, req Request) (Response, error)
+}
+
+// ProviderConfig selects and configures a Provider. Empty fields fall back to
+// the defaults of the selected provider.
+type ProviderConfig struct {
+	Name      string
+	APIURL    string
+	APIKeyEnv string
+	Model     string
+}
+
+// NewProvider builds the Provider described by cfg.
+func NewProvider(cfg ProviderConfig) (Provider, error) {
+	switch strings.ToLower(cfg.Name) {
+	case "", ProviderOpenAI:
+		return newOpenAIProvider(cfg), nil
+	case ProviderAnthropic:
+		return newAnthropicProvider(cfg), nil
+	case ProviderOllama:
+		return newOllamaProvider(cfg), nil
+	default:
+		return nil, fmt.Errorf("unknown provider: %s", cfg.Name)
+	}
+}
+
+// lookupAPIKey reads an API key from the named environment variable.
+func lookupAPIKey(envVar string, required bool) (string, error) {
+	apiKey := os.Getenv(envVar)
+	if apiKey == "" && required {
+		return "", fmt.Errorf("API key not found in environment variable '%s'", envVar)
+	}
+	return apiKey, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
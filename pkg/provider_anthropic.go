@@ -0,0 +1,323 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicURL       = "https://api.anthropic.com/v1/messages"
+	anthropicModel     = "claude-3-5-sonnet-latest"
+	anthropicAPIKeyEnv = "ANTHROPIC_API_KEY"
+	anthropicVersion   = "2023-06-01"
+	anthropicMaxTokens = 4096
+)
+
+// anthropicProvider talks to the Anthropic Messages API.
+type anthropicProvider struct {
+	apiURL    string
+	apiKeyEnv string
+	model     string
+}
+
+func newAnthropicProvider(cfg ProviderConfig) *anthropicProvider {
+	return &anthropicProvider{
+		apiURL:    firstNonEmpty(cfg.APIURL, anthropicURL),
+		apiKeyEnv: firstNonEmpty(cfg.APIKeyEnv, anthropicAPIKeyEnv),
+		model:     firstNonEmpty(cfg.Model, anthropicModel),
+	}
+}
+
+func (p *anthropicProvider) Name() string {
+	return ProviderAnthropic
+}
+
+func (p *anthropicProvider) DefaultModel() string {
+	return p.model
+}
+
+func (p *anthropicProvider) Complete(ctx context.Context, req Request) (Response, error) {
+	apiKey, err := lookupAPIKey(p.apiKeyEnv, true)
+	if err != nil {
+		return Response{}, err
+	}
+
+	payloadBytes, err := p.preparePayload(req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	headers := map[string]string{
+		"x-api-key":         apiKey,
+		"anthropic-version": anthropicVersion,
+	}
+
+	resp, err := openPost(ctx, p.apiURL, payloadBytes, headers, req.OnToken != nil)
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Response{}, anthropicError(resp)
+	}
+
+	if req.OnToken != nil {
+		return readAnthropicStream(req, resp.Body)
+	}
+
+	body, err := readBody(resp.Body)
+	if err != nil {
+		return Response{}, err
+	}
+
+	decoded, err := decodeAnthropicResponse(body)
+	if err != nil {
+		return Response{}, err
+	}
+	decoded.Model = req.Model
+	return decoded, nil
+}
+
+// readAnthropicStream reads a streamed response and forwards every text delta
+// to req.OnToken. Input tokens are reported by message_start and output
+// tokens by message_delta.
+func readAnthropicStream(req Request, body io.Reader) (Response, error) {
+	var content strings.Builder
+	var usage Usage
+	err := readSSE(body, func(_, data string) error {
+		var chunk struct {
+			Type  string `json:"type"`
+			Delta struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"delta"`
+			Message struct {
+				Usage anthropicUsage `json:"usage"`
+			} `json:"message"`
+			Usage anthropicUsage      `json:"usage"`
+			Error *anthropicErrorBody `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return err
+		}
+
+		switch chunk.Type {
+		case "message_start":
+			usage.PromptTokens = chunk.Message.Usage.InputTokens
+		case "message_delta":
+			usage.CompletionTokens = chunk.Usage.OutputTokens
+		case "content_block_delta":
+			if chunk.Delta.Type == "text_delta" {
+				content.WriteString(chunk.Delta.Text)
+				req.OnToken(chunk.Delta.Text)
+			}
+		case "message_stop":
+			return errStreamDone
+		case "error":
+			if chunk.Error != nil {
+				return newAPIError(0, nil, chunk.Error.Type, chunk.Error.Message)
+			}
+			return newAPIError(0, nil, "", data)
+		}
+		return nil
+	})
+	if err := streamResult(err); err != nil {
+		return Response{}, err
+	}
+	return Response{Content: content.String(), Model: req.Model, Usage: usage}, nil
+}
+
+func (p *anthropicProvider) preparePayload(req Request) ([]byte, error) {
+	messages := anthropicMessages(req.Messages)
+
+	maxTokens := anthropicMaxTokens
+	if req.Params.MaxTokens > 0 {
+		maxTokens = req.Params.MaxTokens
+	}
+
+	// The Messages API has no seed parameter, so Params.Seed is not sent, and
+	// no response format, so a Schema is only enforced through the prompt.
+	payload := map[string]interface{}{
+		"model":      req.Model,
+		"max_tokens": maxTokens,
+		"system":     req.System,
+		"messages":   messages,
+	}
+	if req.Params.Temperature != nil {
+		payload["temperature"] = *req.Params.Temperature
+	}
+	if len(req.Tools) > 0 {
+		tools := make([]map[string]interface{}, len(req.Tools))
+		for i, tool := range req.Tools {
+			tools[i] = map[string]interface{}{
+				"name":         tool.Name,
+				"description":  tool.Description,
+				"input_schema": tool.Parameters,
+			}
+		}
+		payload["tools"] = tools
+	}
+	if req.OnToken != nil {
+		payload["stream"] = true
+	}
+	return json.Marshal(payload)
+}
+
+// anthropicMessages converts messages to the Messages API format. Plain text
+// turns are sent as strings; tool calls become tool_use blocks and tool
+// results tool_result blocks of a user turn.
+func anthropicMessages(messages []Message) []map[string]interface{} {
+	hasTools := false
+	for _, m := range messages {
+		if len(m.ToolCalls) > 0 || m.Role == roleTool {
+			hasTools = true
+		}
+	}
+
+	var converted []map[string]interface{}
+	if !hasTools {
+		for _, m := range mergeConsecutiveRoles(messages) {
+			converted = append(converted, map[string]interface{}{"role": m.Role, "content": m.Content})
+		}
+		return converted
+	}
+
+	var lastRole string
+	for _, m := range messages {
+		role := m.Role
+		var blocks []map[string]interface{}
+		switch {
+		case m.Role == roleTool:
+			role = roleUser
+			blocks = append(blocks, map[string]interface{}{"type": "tool_result", "tool_use_id": m.ToolCallID, "content": m.Content})
+		default:
+			if m.Content != "" {
+				blocks = append(blocks, map[string]interface{}{"type": "text", "text": m.Content})
+			}
+			for _, call := range m.ToolCalls {
+				input := json.RawMessage(call.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, map[string]interface{}{"type": "tool_use", "id": call.ID, "name": call.Name, "input": input})
+			}
+		}
+
+		// The Messages API requires user and assistant turns to alternate.
+		if n := len(converted); n > 0 && lastRole == role {
+			converted[n-1]["content"] = append(converted[n-1]["content"].([]map[string]interface{}), blocks...)
+			continue
+		}
+		converted = append(converted, map[string]interface{}{"role": role, "content": blocks})
+		lastRole = role
+	}
+	return converted
+}
+
+// mergeConsecutiveRoles joins adjacent messages with the same role, since the
+// Messages API requires user and assistant turns to alternate.
+func mergeConsecutiveRoles(messages []Message) []Message {
+	var merged []Message
+	for _, m := range messages {
+		if n := len(merged); n > 0 && merged[n-1].Role == m.Role {
+			merged[n-1].Content += "\n\n" + m.Content
+			continue
+		}
+		merged = append(merged, m)
+	}
+	return merged
+}
+
+// anthropicErrorBody is the "error" object of a Messages API response.
+type anthropicErrorBody struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// anthropicError turns a non-200 response into an APIError.
+func anthropicError(resp *http.Response) error {
+	body, err := readBody(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var errResp struct {
+		Error *anthropicErrorBody `json:"error"`
+	}
+	if json.Unmarshal(body, &errResp) != nil || errResp.Error == nil {
+		return newAPIError(resp.StatusCode, resp.Header, "", strings.TrimSpace(string(body)))
+	}
+	return newAPIError(resp.StatusCode, resp.Header, errResp.Error.Type, errResp.Error.Message)
+}
+
+// anthropicUsage is the "usage" object of a Messages API response.
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func decodeAnthropicResponse(body []byte) (Response, error) {
+	var responseMap map[string]interface{}
+	if err := json.Unmarshal(body, &responseMap); err != nil {
+		return Response{}, err
+	}
+	content, err := extractAnthropicContent(responseMap)
+	if err != nil {
+		return Response{}, err
+	}
+
+	var decoded struct {
+		Content []struct {
+			Type  string          `json:"type"`
+			ID    string          `json:"id"`
+			Name  string          `json:"name"`
+			Input json.RawMessage `json:"input"`
+		} `json:"content"`
+		Usage anthropicUsage `json:"usage"`
+	}
+	json.Unmarshal(body, &decoded)
+
+	resp := Response{
+		Content: content,
+		Usage:   Usage{PromptTokens: decoded.Usage.InputTokens, CompletionTokens: decoded.Usage.OutputTokens},
+	}
+	for _, block := range decoded.Content {
+		if block.Type == "tool_use" {
+			resp.ToolCalls = append(resp.ToolCalls, ToolCall{ID: block.ID, Name: block.Name, Arguments: string(block.Input)})
+		}
+	}
+	return resp, nil
+}
+
+func extractAnthropicContent(responseMap map[string]interface{}) (string, error) {
+	if apiErr, ok := responseMap["error"].(map[string]interface{}); ok {
+		errMsg, _ := apiErr["message"].(string)
+		errType, _ := apiErr["type"].(string)
+		return "", newAPIError(0, nil, errType, errMsg)
+	}
+
+	blocks, ok := responseMap["content"].([]interface{})
+	if !ok {
+		return "", fmt.Errorf("unexpected response from Anthropic API")
+	}
+
+	var content strings.Builder
+	for _, b := range blocks {
+		block, ok := b.(map[string]interface{})
+		if !ok || block["type"] != "text" {
+			continue
+		}
+		if text, ok := block["text"].(string); ok {
+			content.WriteString(text)
+		}
+	}
+	return content.String(), nil
+}
@@ -0,0 +1,23 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+const (
+	ollamaURL       = "http://localhost:11434/v1/chat/completions"
+	ollamaModel     = "llama3.1"
+	ollamaAPIKeyEnv = "OLLAMA_API_KEY"
+)
+
+// newOllamaProvider returns a provider for Ollama or any other self-hosted
+// server exposing the OpenAI-compatible chat-completions endpoint. The API key
+// is optional because local servers usually run without authentication.
+func newOllamaProvider(cfg ProviderConfig) *openAIProvider {
+	return &openAIProvider{
+		name:        ProviderOllama,
+		apiURL:      firstNonEmpty(cfg.APIURL, ollamaURL),
+		apiKeyEnv:   firstNonEmpty(cfg.APIKeyEnv, ollamaAPIKeyEnv),
+		model:       firstNonEmpty(cfg.Model, ollamaModel),
+		keyOptional: true,
+	}
+}
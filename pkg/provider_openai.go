@@ -0,0 +1,301 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	openAIURL       = "https://api.openai.com/v1/chat/completions"
+	openAIModel     = "gpt-4o"
+	openAIAPIKeyEnv = "OPENAI_API_KEY"
+)
+
+// openAIProvider talks to the OpenAI chat-completions API and to any server
+// that implements the same wire format.
+type openAIProvider struct {
+	name        string
+	apiURL      string
+	apiKeyEnv   string
+	model       string
+	keyOptional bool
+}
+
+func newOpenAIProvider(cfg ProviderConfig) *openAIProvider {
+	return &openAIProvider{
+		name:      ProviderOpenAI,
+		apiURL:    firstNonEmpty(cfg.APIURL, openAIURL),
+		apiKeyEnv: firstNonEmpty(cfg.APIKeyEnv, openAIAPIKeyEnv),
+		model:     firstNonEmpty(cfg.Model, openAIModel),
+	}
+}
+
+func (p *openAIProvider) Name() string {
+	return p.name
+}
+
+func (p *openAIProvider) DefaultModel() string {
+	return p.model
+}
+
+func (p *openAIProvider) Complete(ctx context.Context, req Request) (Response, error) {
+	apiKey, err := lookupAPIKey(p.apiKeyEnv, !p.keyOptional)
+	if err != nil {
+		return Response{}, err
+	}
+
+	payloadBytes, err := p.preparePayload(req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	headers := map[string]string{}
+	if apiKey != "" {
+		headers["Authorization"] = "Bearer " + apiKey
+	}
+
+	resp, err := openPost(ctx, p.apiURL, payloadBytes, headers, req.OnToken != nil)
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Response{}, openAIError(resp)
+	}
+
+	if req.OnToken != nil {
+		return readOpenAIStream(req, resp.Body)
+	}
+
+	body, err := readBody(resp.Body)
+	if err != nil {
+		return Response{}, err
+	}
+
+	decoded, err := decodeOpenAIResponse(body)
+	if err != nil {
+		return Response{}, err
+	}
+	decoded.Model = req.Model
+	return decoded, nil
+}
+
+// readOpenAIStream reads a streamed response and forwards every content delta
+// to req.OnToken. Usage is reported in the final chunk when it was requested
+// with stream_options.
+func readOpenAIStream(req Request, body io.Reader) (Response, error) {
+	var content strings.Builder
+	var usage Usage
+	err := readSSE(body, func(_, data string) error {
+		if data == "[DONE]" {
+			return errStreamDone
+		}
+
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Usage *Usage           `json:"usage"`
+			Error *openAIErrorBody `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return err
+		}
+		if chunk.Error != nil {
+			return newAPIError(0, nil, chunk.Error.code(), chunk.Error.Message)
+		}
+		if chunk.Usage != nil {
+			usage = *chunk.Usage
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				content.WriteString(choice.Delta.Content)
+				req.OnToken(choice.Delta.Content)
+			}
+		}
+		return nil
+	})
+	if err := streamResult(err); err != nil {
+		return Response{}, err
+	}
+	return Response{Content: content.String(), Model: req.Model, Usage: usage}, nil
+}
+
+func (p *openAIProvider) preparePayload(req Request) ([]byte, error) {
+	messages := []map[string]interface{}{
+		{"role": roleSys, "content": req.System},
+	}
+	for _, m := range req.Messages {
+		message := map[string]interface{}{"role": m.Role, "content": m.Content}
+		if len(m.ToolCalls) > 0 {
+			calls := make([]map[string]interface{}, len(m.ToolCalls))
+			for i, call := range m.ToolCalls {
+				calls[i] = map[string]interface{}{
+					"id":       call.ID,
+					"type":     "function",
+					"function": map[string]interface{}{"name": call.Name, "arguments": call.Arguments},
+				}
+			}
+			message["tool_calls"] = calls
+		}
+		if m.ToolCallID != "" {
+			message["tool_call_id"] = m.ToolCallID
+		}
+		messages = append(messages, message)
+	}
+
+	payload := map[string]interface{}{
+		"model":    req.Model,
+		"messages": messages,
+	}
+	if len(req.Tools) > 0 {
+		tools := make([]map[string]interface{}, len(req.Tools))
+		for i, tool := range req.Tools {
+			tools[i] = map[string]interface{}{
+				"type": "function",
+				"function": map[string]interface{}{
+					"name":        tool.Name,
+					"description": tool.Description,
+					"parameters":  tool.Parameters,
+				},
+			}
+		}
+		payload["tools"] = tools
+	}
+	if req.Params.Temperature != nil {
+		payload["temperature"] = *req.Params.Temperature
+	}
+	if req.Params.MaxTokens > 0 {
+		payload["max_tokens"] = req.Params.MaxTokens
+	}
+	if req.Params.Seed != nil {
+		payload["seed"] = *req.Params.Seed
+	}
+	if req.Schema != nil {
+		payload["response_format"] = map[string]interface{}{
+			"type": "json_schema",
+			"json_schema": map[string]interface{}{
+				"name":   req.Schema.Name,
+				"schema": req.Schema.Definition,
+				"strict": true,
+			},
+		}
+	}
+	if req.OnToken != nil {
+		payload["stream"] = true
+		// Other servers speaking this format may reject stream_options.
+		if p.name == ProviderOpenAI {
+			payload["stream_options"] = map[string]interface{}{"include_usage": true}
+		}
+	}
+
+	return json.Marshal(payload)
+}
+
+// openAIErrorBody is the "error" object of an OpenAI-style response.
+type openAIErrorBody struct {
+	Message string      `json:"message"`
+	Type    string      `json:"type"`
+	Code    interface{} `json:"code"`
+}
+
+// code returns the most specific error identifier the server sent.
+func (e *openAIErrorBody) code() string {
+	if code, ok := e.Code.(string); ok && code != "" {
+		return code
+	}
+	return e.Type
+}
+
+// openAIError turns a non-200 response into an APIError.
+func openAIError(resp *http.Response) error {
+	body, err := readBody(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var errResp struct {
+		Error *openAIErrorBody `json:"error"`
+	}
+	if json.Unmarshal(body, &errResp) != nil || errResp.Error == nil {
+		return newAPIError(resp.StatusCode, resp.Header, "", strings.TrimSpace(string(body)))
+	}
+	return newAPIError(resp.StatusCode, resp.Header, errResp.Error.code(), errResp.Error.Message)
+}
+
+func decodeOpenAIResponse(body []byte) (Response, error) {
+	var decoded struct {
+		Choices []struct {
+			Message struct {
+				Content   *string `json:"content"`
+				ToolCalls []struct {
+					ID       string `json:"id"`
+					Function struct {
+						Name      string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage Usage `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &decoded); err == nil && len(decoded.Choices) > 0 && len(decoded.Choices[0].Message.ToolCalls) > 0 {
+		message := decoded.Choices[0].Message
+		resp := Response{Usage: decoded.Usage}
+		if message.Content != nil {
+			resp.Content = *message.Content
+		}
+		for _, call := range message.ToolCalls {
+			resp.ToolCalls = append(resp.ToolCalls, ToolCall{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments})
+		}
+		return resp, nil
+	}
+
+	var responseMap map[string]interface{}
+	if err := json.Unmarshal(body, &responseMap); err != nil {
+		return Response{}, err
+	}
+	content, err := extractContentFromResponse(responseMap)
+	if err != nil {
+		return Response{}, err
+	}
+	return Response{Content: content, Usage: decoded.Usage}, nil
+}
+
+func extractContentFromResponse(responseMap map[string]interface{}) (string, error) {
+	// Check for errors in the API response
+	if apiErr, ok := responseMap["error"].(map[string]interface{}); ok {
+		errMsg, _ := apiErr["message"].(string)
+		code, _ := apiErr["code"].(string)
+		if code == "" {
+			code, _ = apiErr["type"].(string)
+		}
+		return "", newAPIError(0, nil, code, errMsg)
+	}
+
+	choices, ok := responseMap["choices"].([]interface{})
+	if ok && len(choices) > 0 {
+		firstChoice, ok := choices[0].(map[string]interface{})
+		if ok {
+			message, ok := firstChoice["message"].(map[string]interface{})
+			if ok {
+				content, ok := message["content"].(string)
+				if ok {
+					return content, nil
+				}
+			}
+		}
+	}
+
+	return "", fmt.Errorf("unexpected response from provider: no message content")
+}
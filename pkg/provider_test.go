@@ -0,0 +1,75 @@
+package gpt4client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewProviderUnknown(t *testing.T) {
+	_, err := NewProvider(ProviderConfig{Name: "nope"})
+	require.Error(t, err)
+}
+
+func TestAnthropicProviderComplete(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "test-key", r.Header.Get("x-api-key"))
+
+		var payload map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		require.Equal(t, "claude-test", payload["model"])
+		require.Len(t, payload["messages"], 1)
+
+		w.Write([]byte(`{"content":[{"type":"text","text":"go build ./..."}]}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("TEST_ANTHROPIC_KEY", "test-key")
+	p, err := NewProvider(ProviderConfig{Name: ProviderAnthropic, APIURL: server.URL, APIKeyEnv: "TEST_ANTHROPIC_KEY", Model: "claude-test"})
+	require.NoError(t, err)
+
+	resp, err := p.Complete(context.Background(), Request{
+		Model:    p.DefaultModel(),
+		Messages: []Message{{Role: roleUser, Content: "a"}, {Role: roleUser, Content: "b"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "go build ./...", resp.Content)
+}
+
+func TestOllamaProviderWithoutKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Empty(t, r.Header.Get("Authorization"))
+		w.Write([]byte(`{"choices":[{"message":{"content":"make"}}]}`))
+	}))
+	defer server.Close()
+
+	t.Setenv(ollamaAPIKeyEnv, "")
+	p, err := NewProvider(ProviderConfig{Name: ProviderOllama, APIURL: server.URL})
+	require.NoError(t, err)
+	require.Equal(t, ollamaModel, p.DefaultModel())
+
+	resp, err := p.Complete(context.Background(), Request{Model: p.DefaultModel()})
+	require.NoError(t, err)
+	require.Equal(t, "make", resp.Content)
+}
+
+func TestOpenAIPayloadParams(t *testing.T) {
+	temperature, seed := 0.2, 7
+	p := newOpenAIProvider(ProviderConfig{})
+	data, err := p.preparePayload(Request{
+		Model:  "gpt-4o-mini",
+		Params: Params{Temperature: &temperature, MaxTokens: 100, Seed: &seed},
+	})
+	require.NoError(t, err)
+
+	var payload map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &payload))
+	require.Equal(t, "gpt-4o-mini", payload["model"])
+	require.Equal(t, 0.2, payload["temperature"])
+	require.Equal(t, float64(100), payload["max_tokens"])
+	require.Equal(t, float64(7), payload["seed"])
+}
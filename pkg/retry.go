@@ -0,0 +1,102 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// RetryPolicy bounds how often and how long transient provider errors are
+// retried.
+type RetryPolicy struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// DefaultRetryPolicy is used until SetRetryPolicy is called.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 4,
+	BaseDelay:  time.Second,
+	MaxDelay:   time.Minute,
+}
+
+var retryPolicy = DefaultRetryPolicy
+
+// SetRetryPolicy replaces the retry policy for provider requests.
+func SetRetryPolicy(p RetryPolicy) {
+	retryPolicy = p
+}
+
+// completeWithRetry sends req to p, retrying rate limits, server errors and
+// network failures with exponential backoff. Streamed requests are only
+// retried while no token has been emitted yet.
+func completeWithRetry(ctx context.Context, p Provider, req Request) (Response, error) {
+	streamed := false
+	if onToken := req.OnToken; onToken != nil {
+		req.OnToken = func(token string) {
+			streamed = true
+			onToken(token)
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := p.Complete(ctx, req)
+		if err == nil || streamed || attempt >= retryPolicy.MaxRetries || !isTransient(ctx, err) {
+			return resp, err
+		}
+
+		delay, ok := backoffDelay(attempt, err)
+		if !ok {
+			return resp, err
+		}
+
+		debugLog("Transient provider error (attempt %d/%d), retrying in %s: %v", attempt+1, retryPolicy.MaxRetries, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return Response{}, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// isTransient reports whether err is worth retrying.
+func isTransient(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ErrCassetteMiss) {
+		return false
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Retryable()
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrIdleTimeout)
+}
+
+// backoffDelay returns the wait before retry number attempt+1. A Retry-After
+// hint from the server takes precedence; ok is false when that hint exceeds
+// the policy's maximum delay.
+func backoffDelay(attempt int, err error) (time.Duration, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter, apiErr.RetryAfter <= retryPolicy.MaxDelay
+	}
+
+	delay := retryPolicy.BaseDelay << attempt
+	if delay <= 0 || delay > retryPolicy.MaxDelay {
+		delay = retryPolicy.MaxDelay
+	}
+	// Equal jitter: wait between half and the full backoff.
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1)), true
+}
@@ -0,0 +1,77 @@
+package gpt4client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		status  int
+		code    string
+		message string
+		want    error
+	}{
+		{401, "invalid_api_key", "bad key", ErrAuth},
+		{429, "insufficient_quota", "You exceeded your current quota", ErrQuota},
+		{429, "rate_limit_exceeded", "slow down", ErrRateLimit},
+		{400, "context_length_exceeded", "too long", ErrContextLength},
+		{400, "invalid_request_error", "prompt is too long: 250000 tokens", ErrContextLength},
+		{529, "overloaded_error", "Overloaded", ErrServer},
+		{400, "invalid_request_error", "bad field", nil},
+	}
+	for _, c := range cases {
+		require.Equal(t, c.want, classifyError(c.status, c.code, c.message), c.message)
+	}
+}
+
+func TestCompleteWithRetryHonoursRetryAfter(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("retry-after-ms", "10")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":{"message":"slow down","code":"rate_limit_exceeded"}}`))
+			return
+		}
+		w.Write([]byte(`{"choices":[{"message":{"content":"ok"}}]}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("TEST_OPENAI_KEY", "key")
+	SetRetryPolicy(RetryPolicy{MaxRetries: 2, BaseDelay: time.Millisecond, MaxDelay: time.Second})
+	defer SetRetryPolicy(DefaultRetryPolicy)
+
+	p, err := NewProvider(ProviderConfig{APIURL: server.URL, APIKeyEnv: "TEST_OPENAI_KEY"})
+	require.NoError(t, err)
+
+	resp, err := completeWithRetry(context.Background(), p, Request{Model: "m"})
+	require.NoError(t, err)
+	require.Equal(t, "ok", resp.Content)
+	require.Equal(t, 2, calls)
+}
+
+func TestCompleteWithRetryStopsOnAuthError(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":{"message":"Incorrect API key","code":"invalid_api_key"}}`))
+	}))
+	defer server.Close()
+
+	t.Setenv("TEST_OPENAI_KEY", "key")
+	p, err := NewProvider(ProviderConfig{APIURL: server.URL, APIKeyEnv: "TEST_OPENAI_KEY"})
+	require.NoError(t, err)
+
+	_, err = completeWithRetry(context.Background(), p, Request{Model: "m"})
+	require.True(t, errors.Is(err, ErrAuth))
+	require.Equal(t, 1, calls)
+}
@@ -0,0 +1,58 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import "errors"
+
+// Route overrides the model and generation parameters for one operation, such
+// as "build" or "refactor". Fallback is the model to retry with when the
+// primary one rejects the request as too long or is unavailable.
+type Route struct {
+	Model    string
+	Params   Params
+	Fallback string
+}
+
+// resolveRoute returns the effective route for operation, layering the
+// operation's route over the global settings.
+func resolveRoute(operation string) Route {
+	route := Route{
+		Model:    activeModel(),
+		Params:   settings.Params,
+		Fallback: settings.FallbackModel,
+	}
+
+	override, ok := settings.Routes[operation]
+	if !ok {
+		return route
+	}
+	if override.Model != "" {
+		route.Model = override.Model
+	}
+	if override.Fallback != "" {
+		route.Fallback = override.Fallback
+	}
+	route.Params = mergeParams(route.Params, override.Params)
+	return route
+}
+
+// mergeParams returns base with every parameter set in override replaced.
+func mergeParams(base, override Params) Params {
+	if override.Temperature != nil {
+		base.Temperature = override.Temperature
+	}
+	if override.MaxTokens > 0 {
+		base.MaxTokens = override.MaxTokens
+	}
+	if override.Seed != nil {
+		base.Seed = override.Seed
+	}
+	return base
+}
+
+// shouldFallback reports whether err means another model may succeed where
+// the primary one failed.
+func shouldFallback(err error) bool {
+	return errors.Is(err, ErrContextLength) || errors.Is(err, ErrUnavailable) || errors.Is(err, ErrServer)
+}
@@ -0,0 +1,52 @@
+package gpt4client
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// modelProvider fails every request for the model named in reject.
+type modelProvider struct {
+	reject string
+	models []string
+}
+
+func (p *modelProvider) Name() string         { return "model" }
+func (p *modelProvider) DefaultModel() string { return "default" }
+func (p *modelProvider) Complete(ctx context.Context, req Request) (Response, error) {
+	p.models = append(p.models, req.Model)
+	if req.Model == p.reject {
+		return Response{}, &APIError{Kind: ErrContextLength, Message: "too long"}
+	}
+	return Response{Content: "from " + req.Model}, nil
+}
+
+func TestGetResponseRoutesAndFallsBack(t *testing.T) {
+	t.Setenv(homeEnv, t.TempDir())
+	t.Setenv(cacheEnv, t.TempDir())
+	fake := &modelProvider{reject: "small"}
+	provider = fake
+	settings = Config{
+		Routes: map[string]Route{
+			"build":    {Model: "cheap"},
+			"refactor": {Model: "small", Fallback: "large"},
+		},
+	}
+	defer func() { settings = Config{} }()
+
+	reply, err := GetResponse(context.Background(), "build", "p", uuid.New())
+	require.NoError(t, err)
+	require.Equal(t, "from cheap", reply)
+
+	reply, err = GetResponse(context.Background(), "refactor", "p", uuid.New())
+	require.NoError(t, err)
+	require.Equal(t, "from large", reply)
+
+	reply, err = GetResponse(context.Background(), "test", "p", uuid.New())
+	require.NoError(t, err)
+	require.Equal(t, "from default", reply)
+	require.Equal(t, []string{"cheap", "small", "large", "default"}, fake.models)
+}
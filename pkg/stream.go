@@ -0,0 +1,123 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultIdleTimeout = 30 * time.Second
+	maxSSELineSize     = 1024 * 1024
+)
+
+var streamOutput io.Writer
+
+// SetStreamOutput enables streaming responses. Tokens are written to w as they
+// arrive; passing nil disables streaming and restores the spinner.
+func SetStreamOutput(w io.Writer) {
+	streamOutput = w
+}
+
+// idleTimeoutReader cancels the underlying request when no data has been read
+// for the configured timeout, so slow but steady streams are never cut off.
+type idleTimeoutReader struct {
+	body     io.ReadCloser
+	timer    *time.Timer
+	timeout  time.Duration
+	cancel   context.CancelFunc
+	timedOut atomic.Bool
+}
+
+func newIdleTimeoutReader(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleTimeoutReader {
+	r := &idleTimeoutReader{body: body, timeout: timeout, cancel: cancel}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.timedOut.Store(true)
+		cancel()
+	})
+	return r
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if err != nil && r.timedOut.Load() {
+		return n, fmt.Errorf("%w: no data received from provider for %s", ErrIdleTimeout, r.timeout)
+	}
+	r.timer.Reset(r.timeout)
+	return n, err
+}
+
+func (r *idleTimeoutReader) Close() error {
+	r.timer.Stop()
+	err := r.body.Close()
+	r.cancel()
+	return err
+}
+
+// readSSE parses a server-sent-events stream and calls onEvent for every
+// event with its name (empty when not given) and its data.
+func readSSE(r io.Reader, onEvent func(event, data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSSELineSize)
+
+	var event string
+	var data []string
+	flush := func() error {
+		if len(data) == 0 {
+			event = ""
+			return nil
+		}
+		err := onEvent(event, strings.Join(data, "\n"))
+		event, data = "", nil
+		return err
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if err := flush(); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, ":"):
+			// Comment line, used by servers as keep-alive.
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// ErrIdleTimeout is returned when a provider stops sending data mid-response.
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// errStreamDone stops readSSE once the provider signals the end of a stream.
+var errStreamDone = errors.New("stream done")
+
+// streamResult turns the error of readSSE into the error of the response: nil
+// when the provider signalled the end of the stream, and io.ErrUnexpectedEOF
+// when the connection closed before it did, so a truncated reply is retried
+// instead of returned.
+func streamResult(err error) error {
+	switch {
+	case errors.Is(err, errStreamDone):
+		return nil
+	case err == nil:
+		return io.ErrUnexpectedEOF
+	default:
+		return err
+	}
+}
@@ -0,0 +1,104 @@
+package gpt4client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSSE(t *testing.T) {
+	input := ": keep-alive\nevent: first\ndata: a\ndata: b\n\ndata: c\n\n"
+
+	var events []string
+	err := readSSE(strings.NewReader(input), func(event, data string) error {
+		events = append(events, event+"="+data)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"first=a\nb", "=c"}, events)
+}
+
+func TestOpenAIProviderStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, token := range []string{"go ", "test ", "./..."} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", token)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	t.Setenv("TEST_OPENAI_KEY", "key")
+	p, err := NewProvider(ProviderConfig{APIURL: server.URL, APIKeyEnv: "TEST_OPENAI_KEY"})
+	require.NoError(t, err)
+
+	var tokens []string
+	resp, err := p.Complete(context.Background(), Request{Model: "m", OnToken: func(token string) {
+		tokens = append(tokens, token)
+	}})
+	require.NoError(t, err)
+	require.Equal(t, "go test ./...", resp.Content)
+	require.Len(t, tokens, 3)
+}
+
+func TestTruncatedStreamIsAnError(t *testing.T) {
+	streams := map[string]string{
+		ProviderOpenAI:    "data: {\"choices\":[{\"delta\":{\"content\":\"go \"}}]}\n\n",
+		ProviderAnthropic: "event: content_block_delta\ndata: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"go \"}}\n\n",
+	}
+	for name, stream := range streams {
+		t.Run(name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				fmt.Fprint(w, stream)
+			}))
+			defer server.Close()
+
+			t.Setenv("TEST_KEY", "key")
+			p, err := NewProvider(ProviderConfig{Name: name, APIURL: server.URL, APIKeyEnv: "TEST_KEY", Model: "m"})
+			require.NoError(t, err)
+			_, err = p.Complete(context.Background(), Request{Model: "m", OnToken: func(string) {}})
+			require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+			require.True(t, isTransient(context.Background(), err))
+		})
+	}
+}
+
+func TestSlowGenerationOutlivesIdleTimeout(t *testing.T) {
+	t.Setenv(homeEnv, t.TempDir())
+	t.Setenv(cacheEnv, t.TempDir())
+	var streamed bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		streamed = payload["stream"] == true
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		for _, token := range []string{"go ", "test ", "./", "..."} {
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", token)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	t.Setenv("TEST_OPENAI_KEY", "key")
+	require.NoError(t, Configure(Config{ProviderConfig: ProviderConfig{APIURL: server.URL, APIKeyEnv: "TEST_OPENAI_KEY"}, IdleTimeout: 250 * time.Millisecond}))
+	defer Configure(Config{})
+
+	reply, err := GetResponse(context.Background(), "build", "p", uuid.New())
+	require.NoError(t, err)
+	require.Equal(t, "go test ./...", reply)
+	require.True(t, streamed, "the request is streamed even without --stream")
+}
@@ -0,0 +1,235 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktoken_loader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+const (
+	defaultEncoding      = "cl100k_base"
+	defaultContextWindow = 8192
+	defaultOutputReserve = 4096
+	messageOverhead      = 4
+	budgetWarnRatio      = 0.9
+)
+
+// contextWindows lists known context window sizes by model name prefix. The
+// longest matching prefix wins.
+var contextWindows = map[string]int{
+	"gpt-4o":        128000,
+	"gpt-4.1":       1047576,
+	"gpt-4-turbo":   128000,
+	"gpt-4-32k":     32768,
+	"gpt-4":         8192,
+	"gpt-3.5-turbo": 16385,
+	"o1":            200000,
+	"o3":            200000,
+	"o4":            200000,
+	"claude":        200000,
+	"llama3.1":      128000,
+	"llama3.2":      128000,
+	"llama3":        8192,
+	"mistral":       32768,
+	"qwen2.5":       32768,
+}
+
+// ErrPromptShown is returned instead of a response when prompts are only
+// printed, see SetShowPrompt.
+var ErrPromptShown = errors.New("prompt shown, request not sent")
+
+var (
+	showPrompt  bool
+	encodings   = map[string]*tiktoken.Tiktoken{}
+	encodingsMu sync.Mutex
+)
+
+func init() {
+	// Use the embedded BPE files so token counting never needs the network.
+	tiktoken.SetBpeLoader(tiktoken_loader.NewOfflineLoader())
+}
+
+// SetShowPrompt makes every request print its final prompt and token count
+// and return ErrPromptShown without calling the provider.
+func SetShowPrompt(enabled bool) {
+	showPrompt = enabled
+}
+
+// encodingFor returns the tokenizer for model. Models without a known OpenAI
+// encoding use cl100k_base, which is a close estimate for most others.
+func encodingFor(model string) *tiktoken.Tiktoken {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+
+	if enc, ok := encodings[model]; ok {
+		return enc
+	}
+	enc, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		enc, err = tiktoken.GetEncoding(defaultEncoding)
+	}
+	if err != nil {
+		debugLog("Error loading tokenizer: %v", err)
+		enc = nil
+	}
+	encodings[model] = enc
+	return enc
+}
+
+// CountTokens returns the number of tokens text occupies for model.
+func CountTokens(model, text string) int {
+	enc := encodingFor(model)
+	if enc == nil {
+		return (len(text) + 3) / 4
+	}
+	return len(enc.EncodeOrdinary(text))
+}
+
+// ContextWindow returns the context window of model in tokens, preferring a
+// size configured for that exact model.
+func ContextWindow(model string) int {
+	if tokens, ok := settings.ContextWindows[model]; ok && tokens > 0 {
+		return tokens
+	}
+
+	if tokens, ok := lookupModel(contextWindows, model); ok {
+		return tokens
+	}
+	return defaultContextWindow
+}
+
+// lookupModel returns the entry of table whose key is the longest prefix of
+// model.
+func lookupModel[V any](table map[string]V, model string) (V, bool) {
+	var value V
+	matched, found := "", false
+	for prefix, v := range table {
+		if strings.HasPrefix(model, prefix) && (!found || len(prefix) > len(matched)) {
+			value, matched, found = v, prefix, true
+		}
+	}
+	return value, found
+}
+
+// Budget returns how many tokens the prompt of operation may use, after the
+// system prompt and the space reserved for the reply, and how many tokens the
+// reply may use.
+func Budget(operation string) (prompt, output int) {
+	route := resolveRoute(operation)
+	window := ContextWindow(route.Model)
+
+	output = route.Params.MaxTokens
+	if output <= 0 {
+		output = defaultOutputReserve
+	}
+	if output > window/2 {
+		output = window / 2
+	}
+
+	prompt = window - output - CountTokens(route.Model, systemPrompt()) - messageOverhead
+	return prompt, output
+}
+
+// countMessageTokens estimates the prompt tokens used by messages.
+func countMessageTokens(model string, messages []Message) int {
+	total := 0
+	for _, m := range messages {
+		total += CountTokens(model, m.Content) + messageOverhead
+		for _, call := range m.ToolCalls {
+			total += CountTokens(model, call.Name+call.Arguments)
+		}
+	}
+	return total
+}
+
+// fitHistory drops the oldest turns of history until it fits into budget
+// together with the new message.
+func fitHistory(model string, budget int, history []Message, next Message) []Message {
+	used := countMessageTokens(model, history) + countMessageTokens(model, []Message{next})
+	for len(history) > 0 && used > budget {
+		used -= CountTokens(model, history[0].Content) + messageOverhead
+		history = history[1:]
+		for len(history) > 0 && history[0].Role != roleUser {
+			used -= CountTokens(model, history[0].Content) + messageOverhead
+			history = history[1:]
+		}
+	}
+	return history
+}
+
+// omittedToolResult replaces old tool results that do not fit into the
+// context window.
+const omittedToolResult = "(output omitted to fit the context window)"
+
+// fitToolHistory fits the messages of a tool-calling conversation into
+// budget. The results of earlier tool calls are replaced by a placeholder,
+// oldest first; when that is not enough, the oldest turns after the first
+// message, which states the task, are dropped. The turn answering the last
+// tool calls is kept, and a tool call is never separated from its results.
+func fitToolHistory(model string, budget int, messages []Message) []Message {
+	used := countMessageTokens(model, messages)
+	if used <= budget {
+		return messages
+	}
+
+	fitted := append([]Message(nil), messages...)
+	last := len(fitted) - 1
+	for last > 0 && fitted[last].Role != roleAssistant {
+		last--
+	}
+	for i := 1; i < last && used > budget; i++ {
+		if fitted[i].Role == roleTool && len(fitted[i].Content) > len(omittedToolResult) {
+			used -= CountTokens(model, fitted[i].Content) - CountTokens(model, omittedToolResult)
+			fitted[i].Content = omittedToolResult
+		}
+	}
+
+	for used > budget && len(fitted) > 2 && last > 1 {
+		n := 1
+		for 1+n < len(fitted) && fitted[1+n].Role == roleTool {
+			n++
+		}
+		used -= countMessageTokens(model, fitted[1:1+n])
+		fitted = append(fitted[:1], fitted[1+n:]...)
+		last -= n
+	}
+	return fitted
+}
+
+// checkBudget warns when the request is close to or above the prompt budget
+// and returns the number of prompt tokens used.
+func checkBudget(operation string, req Request) int {
+	budget, _ := Budget(operation)
+	used := countMessageTokens(req.Model, req.Messages)
+	if used > budget {
+		fmt.Printf("Warning: prompt uses %d tokens, more than the %d available for %s; the request will probably be rejected\n", used, budget, req.Model)
+	} else if float64(used) > budgetWarnRatio*float64(budget) {
+		fmt.Printf("Warning: prompt uses %d of %d tokens available for %s\n", used, budget, req.Model)
+	}
+	return used
+}
+
+// printPrompt writes the complete request and its token count to stdout.
+func printPrompt(operation string, req Request) {
+	budget, _ := Budget(operation)
+	used := countMessageTokens(req.Model, req.Messages)
+	fmt.Printf("--- prompt for %s (model %s, %d tokens, budget %d) ---\n", firstNonEmpty(operation, "request"), req.Model, used, budget)
+	fmt.Printf("[%s]\n%s\n", roleSys, req.System)
+	for _, m := range req.Messages {
+		fmt.Printf("[%s]\n%s\n", m.Role, m.Content)
+	}
+	fmt.Println("--- end of prompt ---")
+}
+
+// CountPromptTokens counts the tokens of text for the model routed to
+// operation.
+func CountPromptTokens(operation, text string) int {
+	return CountTokens(resolveRoute(operation).Model, text)
+}
@@ -0,0 +1,62 @@
+package gpt4client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextWindowPrefersConfiguredSize(t *testing.T) {
+	require.Equal(t, 128000, ContextWindow("gpt-4o-mini"))
+	require.Equal(t, 8192, ContextWindow("gpt-4"))
+	require.Equal(t, defaultContextWindow, ContextWindow("unknown-model"))
+
+	saved := settings
+	defer func() { settings = saved }()
+	settings.ContextWindows = map[string]int{"unknown-model": 1000}
+	require.Equal(t, 1000, ContextWindow("unknown-model"))
+}
+
+func TestFitHistoryDropsOldestTurns(t *testing.T) {
+	history := []Message{
+		{Role: roleUser, Content: "first question"},
+		{Role: roleAssistant, Content: "first answer"},
+		{Role: roleUser, Content: "second question"},
+		{Role: roleAssistant, Content: "second answer"},
+	}
+	next := Message{Role: roleUser, Content: "third question"}
+
+	require.Len(t, fitHistory("gpt-4", 1000, history, next), 4)
+
+	budget := countMessageTokens("gpt-4", history[2:]) + countMessageTokens("gpt-4", []Message{next})
+	fitted := fitHistory("gpt-4", budget, history, next)
+	require.Equal(t, history[2:], fitted)
+
+	require.Empty(t, fitHistory("gpt-4", 1, history, next))
+}
+
+func TestFitToolHistoryOmitsOldResultsFirst(t *testing.T) {
+	long := strings.Repeat("output line\n", 200)
+	call := func(id string) Message {
+		return Message{Role: roleAssistant, ToolCalls: []ToolCall{{ID: id, Name: "read_file", Arguments: "{}"}}}
+	}
+	messages := []Message{
+		{Role: roleUser, Content: "the task"},
+		call("1"), {Role: roleTool, Content: long, ToolCallID: "1"},
+		call("2"), {Role: roleTool, Content: long, ToolCallID: "2"},
+		call("3"), {Role: roleTool, Content: long, ToolCallID: "3"},
+	}
+
+	require.Equal(t, messages, fitToolHistory("gpt-4", 100000, messages))
+
+	fitted := fitToolHistory("gpt-4", countMessageTokens("gpt-4", messages[5:])+200, messages)
+	require.Len(t, fitted, len(messages))
+	require.Equal(t, omittedToolResult, fitted[2].Content)
+	require.Equal(t, omittedToolResult, fitted[4].Content)
+	require.Equal(t, long, fitted[6].Content)
+	require.Equal(t, long, messages[2].Content)
+
+	fitted = fitToolHistory("gpt-4", countMessageTokens("gpt-4", messages[5:])+20, messages)
+	require.Equal(t, append([]Message{messages[0]}, messages[5:]...), fitted)
+}
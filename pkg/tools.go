@@ -0,0 +1,70 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+const roleTool = "tool"
+
+// Tool is a function the model may ask to call. Parameters is the JSON
+// schema of its arguments.
+type Tool struct {
+	Name        string
+	Description string
+	Parameters  map[string]interface{}
+}
+
+// ToolCall is a call of a Tool requested by the model. Arguments holds the
+// arguments as a JSON object.
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// UserMessage returns a user turn with content.
+func UserMessage(content string) Message {
+	return Message{Role: roleUser, Content: content}
+}
+
+// ToolResult returns the turn answering call with content.
+func ToolResult(call ToolCall, content string) Message {
+	return Message{Role: roleTool, Content: content, ToolCallID: call.ID}
+}
+
+// Message returns the assistant turn of the response, including the tool
+// calls it requested.
+func (r Response) Message() Message {
+	return Message{Role: roleAssistant, Content: r.Content, ToolCalls: r.ToolCalls}
+}
+
+// Chat sends messages, which the caller keeps track of, together with the
+// tools the model may call, using the model and parameters routed to
+// operation. Unlike GetResponse the stored conversation is neither read nor
+// extended; convID only tags the recorded usage. Messages that do not fit into
+// the context window are shortened, see fitToolHistory. Tool requests are
+// never streamed.
+func Chat(ctx context.Context, operation string, convID uuid.UUID, messages []Message, tools []Tool) (Response, error) {
+	route := resolveRoute(operation)
+	budget, _ := Budget(operation)
+	req := Request{
+		Model:    route.Model,
+		System:   systemPrompt(),
+		Messages: fitToolHistory(route.Model, budget, messages),
+		Params:   route.Params,
+		Tools:    tools,
+	}
+
+	if showPrompt {
+		printPrompt(operation, req)
+		return Response{}, ErrPromptShown
+	}
+	checkBudget(operation, req)
+
+	return sendWithFallback(ctx, convID, operation, route, req)
+}
@@ -0,0 +1,215 @@
+//go:build !lint
+// +build !lint
+
+package gpt4client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const usageFile = "usage.jsonl"
+
+// Price is the cost of a model in US dollars per million tokens.
+type Price struct {
+	Input  float64
+	Output float64
+}
+
+// defaultPrices lists list prices by model name prefix. The longest matching
+// prefix wins; models without a price, such as local ones, cost nothing.
+var defaultPrices = map[string]Price{
+	"gpt-4o":            {Input: 2.5, Output: 10},
+	"gpt-4o-mini":       {Input: 0.15, Output: 0.6},
+	"gpt-4.1":           {Input: 2, Output: 8},
+	"gpt-4.1-mini":      {Input: 0.4, Output: 1.6},
+	"gpt-4.1-nano":      {Input: 0.1, Output: 0.4},
+	"gpt-4-turbo":       {Input: 10, Output: 30},
+	"gpt-4":             {Input: 30, Output: 60},
+	"gpt-3.5-turbo":     {Input: 0.5, Output: 1.5},
+	"o3-mini":           {Input: 1.1, Output: 4.4},
+	"o4-mini":           {Input: 1.1, Output: 4.4},
+	"claude-3-5-haiku":  {Input: 0.8, Output: 4},
+	"claude-3-5-sonnet": {Input: 3, Output: 15},
+	"claude-3-7-sonnet": {Input: 3, Output: 15},
+	"claude-sonnet-4":   {Input: 3, Output: 15},
+	"claude-3-opus":     {Input: 15, Output: 75},
+	"claude-opus-4":     {Input: 15, Output: 75},
+}
+
+// ErrBudgetExceeded is returned instead of sending a request once the usage
+// limits of the run are reached.
+var ErrBudgetExceeded = errors.New("usage budget exceeded")
+
+// UsageRecord is one entry of the usage ledger. Estimated is set when the
+// provider did not report usage and the tokens were counted locally.
+type UsageRecord struct {
+	Time             time.Time `json:"time"`
+	ConversationID   uuid.UUID `json:"conversation_id"`
+	Command          string    `json:"command,omitempty"`
+	Operation        string    `json:"operation,omitempty"`
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Cost             float64   `json:"cost"`
+	Estimated        bool      `json:"estimated,omitempty"`
+}
+
+// UsageLimits bound the spend of a single run. Zero values disable a limit.
+type UsageLimits struct {
+	MaxCost   float64
+	MaxTokens int
+}
+
+var (
+	commandName string
+	limits      UsageLimits
+	spentCost   float64
+	spentTokens int
+	usageMu     sync.Mutex
+)
+
+// SetCommand sets the command name recorded with every request.
+func SetCommand(name string) {
+	commandName = name
+}
+
+// SetUsageLimits sets the limits of the current run and resets its spend.
+func SetUsageLimits(l UsageLimits) {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	limits = l
+	spentCost, spentTokens = 0, 0
+}
+
+// priceFor returns the price of model, preferring the configured table.
+func priceFor(model string) Price {
+	if price, ok := lookupModel(settings.Prices, model); ok {
+		return price
+	}
+	price, _ := lookupModel(defaultPrices, model)
+	return price
+}
+
+// Cost returns the estimated cost in US dollars of usage on model.
+func Cost(model string, usage Usage) float64 {
+	price := priceFor(model)
+	return (float64(usage.PromptTokens)*price.Input + float64(usage.CompletionTokens)*price.Output) / 1e6
+}
+
+// checkUsageLimits returns ErrBudgetExceeded when the run has reached one of
+// its limits.
+func checkUsageLimits() error {
+	usageMu.Lock()
+	defer usageMu.Unlock()
+	if limits.MaxCost > 0 && spentCost >= limits.MaxCost {
+		return fmt.Errorf("%w: spent $%.4f of $%.4f", ErrBudgetExceeded, spentCost, limits.MaxCost)
+	}
+	if limits.MaxTokens > 0 && spentTokens >= limits.MaxTokens {
+		return fmt.Errorf("%w: used %d of %d tokens", ErrBudgetExceeded, spentTokens, limits.MaxTokens)
+	}
+	return nil
+}
+
+// recordUsage adds the usage of a completed request to the run totals and the
+// ledger.
+func recordUsage(convID uuid.UUID, operation string, req Request, resp Response) {
+	record := UsageRecord{
+		Time:             time.Now(),
+		ConversationID:   convID,
+		Command:          commandName,
+		Operation:        operation,
+		Provider:         provider.Name(),
+		Model:            req.Model,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	}
+	if record.PromptTokens == 0 && record.CompletionTokens == 0 {
+		record.PromptTokens = CountTokens(req.Model, req.System) + countMessageTokens(req.Model, req.Messages)
+		record.CompletionTokens = CountTokens(req.Model, resp.Content)
+		record.Estimated = true
+	}
+	record.Cost = Cost(req.Model, Usage{PromptTokens: record.PromptTokens, CompletionTokens: record.CompletionTokens})
+
+	usageMu.Lock()
+	spentCost += record.Cost
+	spentTokens += record.PromptTokens + record.CompletionTokens
+	usageMu.Unlock()
+
+	debugLog("Usage: %d prompt + %d completion tokens, $%.4f", record.PromptTokens, record.CompletionTokens, record.Cost)
+	if err := appendUsage(record); err != nil {
+		debugLog("Error recording usage: %v", err)
+	}
+}
+
+func usagePath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, usageFile), nil
+}
+
+func appendUsage(record UsageRecord) error {
+	path, err := usagePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadUsage returns every record of the usage ledger, oldest first.
+func LoadUsage() ([]UsageRecord, error) {
+	path, err := usagePath()
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []UsageRecord
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
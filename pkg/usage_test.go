@@ -0,0 +1,64 @@
+package gpt4client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// usageProvider returns a fixed reply with fixed token usage.
+type usageProvider struct {
+	calls int
+}
+
+func (p *usageProvider) Name() string         { return "fake" }
+func (p *usageProvider) DefaultModel() string { return "gpt-4o" }
+
+func (p *usageProvider) Complete(ctx context.Context, req Request) (Response, error) {
+	p.calls++
+	return Response{Content: "ok", Model: req.Model, Usage: Usage{PromptTokens: 1000, CompletionTokens: 500}}, nil
+}
+
+func TestUsageIsRecordedAndLimited(t *testing.T) {
+	t.Setenv(homeEnv, t.TempDir())
+	t.Setenv(cacheEnv, t.TempDir())
+	fake := &usageProvider{}
+	SetProvider(fake, "")
+	defer SetProvider(newOpenAIProvider(ProviderConfig{}), "")
+	SetCommand("build")
+	SetUsageLimits(UsageLimits{MaxTokens: 2000})
+	defer SetUsageLimits(UsageLimits{})
+
+	convID := uuid.New()
+	_, err := GetResponse(context.Background(), "build", "p", convID)
+	require.NoError(t, err)
+	_, err = GetResponse(context.Background(), "build", "p", convID)
+	require.NoError(t, err)
+	_, err = GetResponse(context.Background(), "build", "p", convID)
+	require.True(t, errors.Is(err, ErrBudgetExceeded))
+	require.Equal(t, 2, fake.calls)
+
+	records, err := LoadUsage()
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, convID, records[0].ConversationID)
+	require.Equal(t, "build", records[0].Command)
+	require.Equal(t, "gpt-4o", records[0].Model)
+	require.InDelta(t, 0.0075, records[0].Cost, 1e-9)
+	require.False(t, records[0].Estimated)
+}
+
+func TestCostPrefersConfiguredPrice(t *testing.T) {
+	saved := settings
+	defer func() { settings = saved }()
+
+	usage := Usage{PromptTokens: 1e6, CompletionTokens: 1e6}
+	require.InDelta(t, 0.75, Cost("gpt-4o-mini-2024-07-18", usage), 1e-9)
+	require.Zero(t, Cost("llama3.1", usage))
+
+	settings.Prices = map[string]Price{"llama3.1": {Input: 1, Output: 2}}
+	require.InDelta(t, 3, Cost("llama3.1", usage), 1e-9)
+}